@@ -17,20 +17,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	gourl "net/url"
 	"os"
 	"os/signal"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alex19861108/meg-sender/requester"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -50,13 +59,56 @@ var (
 	dataType    = flag.String("f", "TEXT", "")
 	output      = flag.String("o", "", "")
 
-	qps = flag.Int("qps", 0, "")
-	c   = flag.Int("c", 50, "")
-	n   = flag.Int("n", 0, "")
-	t   = flag.Int("t", 0, "")
-	T   = flag.Int("T", 60, "")
+	timeSeries         = flag.String("timeseries", "", "")
+	timeSeriesInterval = flag.Float64("timeseries-interval", 1, "")
+
+	retries = flag.Int("retries", 0, "")
+	retryOn = flag.String("retry-on", "5xx,timeout,conn", "")
+	backoff = flag.String("backoff", "exp:50ms..2s", "")
+
+	dialTimeout = flag.Duration("dial-timeout", 0, "")
+	tlsTimeout  = flag.Duration("tls-timeout", 0, "")
+	ttfbTimeout = flag.Duration("ttfb-timeout", 0, "")
+	bodyTimeout = flag.Duration("body-timeout", 0, "")
+	hedge       = flag.Bool("hedge", false, "")
+	hedgeDelay  = flag.Duration("hedge-delay", 0, "")
+
+	oauth2TokenURL     = flag.String("oauth2-token-url", "", "")
+	oauth2ClientID     = flag.String("oauth2-client-id", "", "")
+	oauth2ClientSecret = flag.String("oauth2-client-secret", "", "")
+	oauth2Scope        = flag.String("oauth2-scope", "", "")
+
+	sign          = flag.String("sign", "", "")
+	signKey       = flag.String("sign-key", "", "")
+	signCanonical = flag.String("sign-canonical", "", "")
+	signHeader    = flag.String("sign-header", "", "")
+	jwtClaims     = flag.String("jwt-claims", "", "")
+	jwtTTL        = flag.Duration("jwt-ttl", time.Hour, "")
+
+	cookies     = flag.Bool("cookies", false, "")
+	cookieFile  = flag.String("cookie-file", "", "")
+	cookieReset = flag.Bool("cookie-reset", false, "")
+
+	think  = flag.String("think", "", "")
+	pacing = flag.Duration("pacing", 0, "")
+
+	captureFile    = flag.String("capture", "", "")
+	captureDir     = flag.String("capture-dir", "", "")
+	captureSample  = flag.String("capture-sample", "", "")
+	captureMaxBody = flag.Int("capture-max-body", requester.DefaultCaptureMaxBody, "")
+
+	qps   = flag.Float64("qps", 0, "")
+	burst = flag.Int("burst", 0, "")
+	c     = flag.Int("c", 50, "")
+	n     = flag.Int("n", 0, "")
+	t     = flag.Int("t", 0, "")
+	T     = flag.Int("T", 60, "")
+
+	grace = flag.Int("grace", 10, "")
 
 	h2   = flag.Bool("h2", false, "")
+	h2c  = flag.Bool("h2c", false, "")
+	h3   = flag.Bool("h3", false, "")
 	cpus = flag.Int("cpus", runtime.GOMAXPROCS(-1), "")
 
 	disableCompression = flag.Bool("disable-compression", false, "")
@@ -64,15 +116,80 @@ var (
 	disableRedirects   = flag.Bool("disable-redirects", false, "")
 	disableOutput      = flag.Bool("disable-output", false, "")
 	randomInput        = flag.Bool("random-input", false, "")
+	once               = flag.Bool("once", false, "")
 	async              = flag.Bool("async", false, "")
 	proxyAddr          = flag.String("x", "", "")
+
+	h2Conns          = flag.Int("h2-conns", 0, "")
+	h2StreamsPerConn = flag.Int("h2-streams-per-conn", 0, "")
+	h3ZeroRTT        = flag.Bool("h3-0rtt", false, "")
+
+	wsIDField = flag.String("ws-id-field", "", "")
+
+	stream            = flag.Bool("stream", false, "")
+	streamDelimiter   = flag.String("stream-delimiter", `\n\n`, "")
+	maxStreamDuration = flag.Duration("max-stream-duration", 0, "")
+
+	agents     = flag.String("agents", "", "")
+	agentToken = flag.String("token", "", "")
+
+	metricsAddr = flag.String("metrics-addr", "", "")
+	testName    = flag.String("name", "", "")
+	tagField    = flag.String("tag-field", "", "")
+
+	influxURL   = flag.String("influx-url", "", "")
+	influxToken = flag.String("influx-token", "", "")
+	otlpURL     = flag.String("otlp-url", "", "")
+	statsdAddr  = flag.String("statsd-addr", "", "")
+
+	logFile   = flag.String("log-file", "", "")
+	logLevel  = flag.String("log-level", "", "")
+	logFormat = flag.String("log-format", "", "")
+
+	grpcMode  = flag.Bool("grpc", false, "")
+	grpcCall  = flag.String("call", "", "")
+	grpcProto = flag.String("proto", "", "")
 )
 
 var usage = `Usage: meg_sender [options...] <url>
+       meg_sender agent [-listen addr] [-token token]
+       meg_sender coordinate -agents host:port,... [-token token] [options...] <url>
+       meg_sender compare [compare options...] baseline.json current.json
+
+"agent" waits for tests from a coordinator, listening on -listen (default
+127.0.0.1:7000). A test chooses the URLs the agent sends requests to and the
+local files it reads, so an agent listening on other addresses requires
+-token, a secret the coordinator must send with the same -token; keep the
+agents on a trusted network all the same. "coordinate" runs the test on the agents instead of locally: -n, -c
+and -qps are split across them, they start at the same time and their results
+are merged into one report. Ctrl-C on the coordinator stops the agents. Input
+files are read by the coordinator; files referenced by -f FORM rows must exist
+on the agents. The test is sent to the agents in plain text, so -sign
+and -oauth2-token-url cannot be used with coordinate.
+
+"compare" compares two runs saved with -o json=FILE: it prints their
+percentiles, RPS and error rates side by side and exits with status 1 if the
+current run regressed beyond the tolerances. Latency increases only count
+when a Mann-Whitney U test finds the response times significantly slower.
+Compare options:
+  -latency-tolerance    Allowed increase of each percentile, in percent.
+                        Default is 10.
+  -rps-tolerance        Allowed decrease of the RPS, in percent. Default is 10.
+  -error-tolerance      Allowed increase of the error rate, in percentage
+                        points. Default is 1.
+  -alpha                Significance level of the latency test. Default is 0.05.
+
+A ws:// or wss:// url load tests a WebSocket endpoint: each worker keeps a
+connection open and sends the -d/-D rows as messages, timing each reply.
+
+With -grpc the url is http://host:port (plaintext) or https://host:port (TLS)
+of a gRPC server, the -d/-D rows are JSON request messages and -H headers are
+sent as metadata.
 
 Options:
   -m    HTTP method, one of GET, POST, PUT, DELETE, HEAD, OPTIONS. Default is [GET].
-  -qps  Rate limit, in seconds (QPS). If not set, send request one by one.
+  -qps  Rate limit of all workers together, in requests per second (QPS).
+        May be fractional, e.g. 0.5. If not set, send request one by one.
   -n    Number of requests to run. Default is [0].
   -t    Timeout for all request in seconds. Default is [0].
 
@@ -90,9 +207,27 @@ Options:
   -a    Basic authentication, username:password.
   -x    HTTP Proxy address as host:port.
   -h2   Enable HTTP/2.
+  -h2c  Enable HTTP/2 over cleartext TCP with prior knowledge (h2c).
+        Requires -h2-conns.
+  -h3   Enable HTTP/3 over QUIC. The url must be https.
   -o    Output type. If none provided, a summary is printed.
-        "csv" is the only supported alternative. Dumps the response
-        metrics in comma-separated values format.
+        "csv" dumps the response metrics in comma-separated values
+        format. "html=FILE" also writes a self-contained HTML report
+        with charts to FILE, "json=FILE" saves the raw results to FILE
+        for "compare". The csv rows end with the offset of each request
+        from the start of the test in seconds and its absolute send time.
+
+  -burst                Number of requests that may be sent at once to catch
+                        up with -qps after a stall. Default is 1, evenly
+                        spaced requests, with which time lost to slow
+                        responses or late timers is not made up. Above a few
+                        thousand QPS, a burst of some milliseconds' worth of
+                        requests keeps the rate.
+
+  -timeseries           Write per-interval aggregates to this file: requests,
+                        errors, status classes and latency percentiles. The
+                        file is JSON lines if it ends in .jsonl, else CSV.
+  -timeseries-interval  Seconds per time-series interval. Default is 1.
 
   -host                 HTTP Host header.
   -cpus                 Number of used cpu cores.
@@ -103,8 +238,149 @@ Options:
                         connections between different HTTP requests.
   -disable-redirects    Disable following of HTTP redirects
   -disable-output       Disable response output.
+  -oauth2-token-url     OAuth2 token endpoint. A token is fetched with the
+                        client credentials grant before the test, sent as
+                        "Authorization: Bearer" on every request and
+                        refreshed in the background before it expires. The
+                        report counts the token requests separately.
+  -oauth2-client-id     OAuth2 client ID.
+  -oauth2-client-secret OAuth2 client secret.
+  -oauth2-scope         OAuth2 scopes, separated by spaces or commas.
+  -sign                 Sign every request: hmac, sigv4:REGION/SERVICE with
+                        the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+                        AWS_SESSION_TOKEN environment variables, jwt:HS256
+                        or jwt:RS256 for a bearer token.
+  -sign-key             HMAC or HS256 secret, or @FILE to read it, e.g. the
+                        PEM private key for RS256.
+  -sign-canonical       Template of the string HMAC signs, with \n for a
+                        newline and {{.Method}}, {{.Path}}, {{.Query}},
+                        {{.Host}}, {{.Now}}, {{.Nonce}}, {{.Body}},
+                        {{.BodySHA256}} and {{.Header "Name"}}. Default is
+                        the method, path, query, time and body hash. The
+                        time goes into the X-Timestamp header.
+  -sign-header          Header of the HMAC signature or the JWT. Default is
+                        X-Signature and Authorization.
+  -jwt-claims           Template of the JWT claims in JSON, with the fields
+                        of -sign-canonical and {{.Exp}}. Default is
+                        {"iat":{{.Now}},"exp":{{.Exp}}}. A token is reused
+                        until near expiry unless the claims use {{.Nonce}}
+                        or the request.
+  -jwt-ttl              Lifetime of a JWT. Default is 1h.
+  -cookies              Give every worker a cookie jar that keeps the cookies
+                        set by responses across its requests, like a browser
+                        session. A -H "Cookie: ..." header is still sent on
+                        every request, followed by the cookies of the jar.
+  -cookie-file          Cookies every jar starts with, from a Netscape cookie
+                        file as written by curl -c. Implies -cookies.
+  -cookie-reset         Empty the jar before every request, back to the
+                        -cookie-file cookies, so each is a new session.
+  -capture              Save responses as JSON lines to this file instead of
+                        printing them: input, headers, status, timing and
+                        the body.
+  -capture-dir          Save responses to this directory, one file each.
+  -capture-sample       Which responses to save, comma-separated: errors,
+                        non-2xx, every=N, first=N, slowest=N. Default is all.
+  -capture-max-body     Bytes of each body saved. Default is 4096.
   -random-input         Enable random input when input has multi rows.
+  -once                 Send every input row exactly once, spread over the
+                        workers, and stop when the input is exhausted.
+                        -n is not needed.
   -async                Enable send requests asynchronously in single worker.
+  -group                Request group of a mix, as comma-separated key=value
+                        pairs: name, weight, and optionally url, m, D and f
+                        overriding those of the test. For example,
+                        -group name=search,weight=70,m=POST,D=search.txt
+                        -group name=detect,weight=30,url=http://host/detect
+                        The groups take turns by weight and the report is
+                        broken down per group. Cannot be used with -once.
+  -think                Pause of every worker between iterations: WAIT,
+                        MIN..MAX (uniform), normal:MEAN,STDDEV or exp:MEAN.
+                        For example, -think 200ms..1s.
+  -pacing               Make every iteration of a worker take this long,
+                        e.g. 1s, pausing for what the request leaves of it.
+                        The report splits the workers' time into service
+                        and think time.
+  -retries              Retry failed HTTP requests up to this many times.
+                        Only the last attempt is measured: latencies and
+                        status codes are those of the last attempt, and the
+                        report tells the retryable failures, how many
+                        attempts were sent and the end-to-end time with the
+                        waits.
+  -retry-on             What is retried, comma-separated: 5xx, 429, timeout,
+                        conn. Default is 5xx,timeout,conn.
+  -backoff              Wait between retries, exp:MIN..MAX doubling from MIN
+                        up to MAX or const:WAIT, with jitter. A Retry-After
+                        header takes precedence, up to MAX or 10s. Default
+                        is exp:50ms..2s.
+  -dial-timeout         Limit on getting a connection, e.g. 500ms.
+  -tls-timeout          Limit on the TLS handshake.
+  -ttfb-timeout         Limit on the wait for the first response byte once
+                        the request is written.
+  -body-timeout         Limit on reading the response body. Requests cut off
+                        by one of these fail with "dial timeout", "TLS
+                        handshake timeout", "first byte timeout" or "body
+                        timeout". -T still limits the whole request.
+  -hedge                Send a duplicate of an HTTP request that is slower
+                        than -hedge-delay and take the first response. The
+                        report tells how often duplicates were sent and won.
+  -hedge-delay          Wait before hedging, e.g. 100ms. Default is the p95
+                        of the recent response times.
+  -grace                Seconds in-flight requests may take to complete after
+                        Ctrl-C or SIGTERM, which print the report of the
+                        completed requests. Default is 10. A second Ctrl-C
+                        exits at once.
+
+  -h2-conns             Number of HTTP/2 connections shared by all workers.
+                        Workers are spread over the connections and their
+                        requests are multiplexed as concurrent streams.
+                        Requires -h2 or -h2c.
+  -h2-streams-per-conn  Maximum number of concurrent streams on each
+                        connection. Default is the server's limit.
+  -h3-0rtt              Send GET and HEAD requests as 0-RTT early data when
+                        an HTTP/3 session can be resumed. Requires -h3.
+
+  -ws-id-field          JSON field correlating a WebSocket message with its
+                        reply. If not set, the next message received is
+                        taken as the reply.
+
+  -stream               Measure streamed responses (Server-Sent Events, JSON
+                        lines, token streams) event by event: time to first
+                        event, gaps between events and events per response.
+                        Unless disabled, the events are printed as they
+                        arrive, one per line.
+  -stream-delimiter     Separator of the events in a streamed response, with
+                        Go escapes. Default is "\n\n" (Server-Sent Events),
+                        use "\n" for JSON lines. Quotes need no escaping.
+  -max-stream-duration  Cut off streamed responses after this long, e.g. 30s.
+                        Default is 0, no limit.
+
+  -grpc                 Make unary gRPC calls instead of HTTP requests.
+  -call                 gRPC method to call, as pkg.Service/Method.
+  -proto                .proto file declaring the method. If not set, the
+                        method is resolved through server reflection.
+
+  -metrics-addr         Serve Prometheus metrics of the running test on this
+                        address, e.g. :9102, at /metrics.
+  -name                 Test name, used as the "test" label of the metrics
+                        and sinks.
+  -tag-field            JSON field of the input rows whose value is used as
+                        the "tag" label of the metrics of each row.
+
+  -influx-url           Write every result to InfluxDB, given the write
+                        endpoint with its parameters, e.g.
+                        http://localhost:8086/api/v2/write?org=o&bucket=b
+  -influx-token         InfluxDB API token.
+  -otlp-url             Export results as OpenTelemetry metrics to this
+                        OTLP/HTTP endpoint, e.g. http://localhost:4318/v1/metrics
+  -statsd-addr          Send results to the statsd server at host:port.
+
+  -log-file             Write the responses and errors to this file instead of
+                        stdout and stderr, as log records.
+  -log-level            Least level logged: debug, info (which includes the
+                        responses), warn or error. Default is info.
+  -log-format           Log record format, text or json. Default is text.
+                        Setting any -log option turns the output into log
+                        records, on stderr unless -log-file is set.
 
   -more                 Provides information on DNS lookup, dialup, request and
                         response timings.
@@ -117,11 +393,41 @@ func main() {
 
 	var hs headerSlice
 	flag.Var(&hs, "H", "")
+	var gs headerSlice
+	flag.Var(&gs, "group", "")
 
-	flag.Parse()
+	args := os.Args[1:]
+	var coordinate bool
+	if len(args) > 0 {
+		switch args[0] {
+		case "agent":
+			runAgent(args[1:])
+			return
+		case "compare":
+			runCompare(args[1:])
+			return
+		case "coordinate":
+			coordinate = true
+			args = args[1:]
+		}
+	}
+	flag.CommandLine.Parse(args)
+	setupLogging()
 	if flag.NArg() < 1 {
 		usageAndExit("")
 	}
+	if coordinate && *agents == "" {
+		usageAndExit("coordinate requires -agents.")
+	}
+	if !coordinate && *agents != "" {
+		usageAndExit("-agents can only be used with coordinate.")
+	}
+	if !coordinate && *agentToken != "" {
+		usageAndExit("-token can only be used with agent and coordinate.")
+	}
+	if coordinate && (*metricsAddr != "" || *influxURL != "" || *otlpURL != "" || *statsdAddr != "") {
+		usageAndExit("-metrics-addr, -influx-url, -otlp-url and -statsd-addr cannot be used with coordinate.")
+	}
 
 	runtime.GOMAXPROCS(*cpus)
 	num := *n
@@ -137,7 +443,7 @@ func main() {
 		if num <= conc {
 			usageAndExit("-c cannot be smaller than 1.")
 		}
-	} else {
+	} else if !*once {
 		if num <= 0 || conc <= 0 {
 			usageAndExit("-n and -c cannot be smaller than 1.")
 		}
@@ -147,11 +453,74 @@ func main() {
 		}
 	}
 
+	if *grace < 0 {
+		usageAndExit("-grace cannot be negative.")
+	}
+
+	if qps < 0 || *burst < 0 {
+		usageAndExit("-qps and -burst cannot be negative.")
+	}
+	if *burst > 0 && qps == 0 {
+		usageAndExit("-burst requires -qps.")
+	}
+
 	if *async && qps <= 0 {
 		usageAndExit("when async is set, qps is required.")
 	}
 
+	if *h2Conns > 0 {
+		if !*h2 && !*h2c {
+			usageAndExit("-h2-conns requires -h2 or -h2c.")
+		}
+		if *proxyAddr != "" {
+			usageAndExit("-x cannot be used with -h2-conns.")
+		}
+	} else if *h2c {
+		usageAndExit("-h2c requires -h2-conns.")
+	}
+	if *h2StreamsPerConn < 0 {
+		usageAndExit("-h2-streams-per-conn cannot be smaller than 0.")
+	}
+
+	if *h3 {
+		if *h2 || *h2c {
+			usageAndExit("-h3 cannot be used with -h2 or -h2c.")
+		}
+		if *proxyAddr != "" {
+			usageAndExit("-x cannot be used with -h3.")
+		}
+	} else if *h3ZeroRTT {
+		usageAndExit("-h3-0rtt requires -h3.")
+	}
+
 	url := flag.Args()[0]
+	if strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+		if *async {
+			usageAndExit("-async cannot be used with a WebSocket url.")
+		}
+		if *h2 || *h2c || *h3 {
+			usageAndExit("-h2, -h2c and -h3 cannot be used with a WebSocket url.")
+		}
+	} else if *wsIDField != "" {
+		usageAndExit("-ws-id-field requires a WebSocket url.")
+	}
+	if *grpcMode {
+		if *grpcCall == "" {
+			usageAndExit("-grpc requires -call.")
+		}
+		if *async || *h2 || *h2c || *h3 {
+			usageAndExit("-async, -h2, -h2c and -h3 cannot be used with -grpc.")
+		}
+	} else if *grpcCall != "" || *grpcProto != "" {
+		usageAndExit("-call and -proto require -grpc.")
+	}
+	delimiter, err := parseDelimiter(*streamDelimiter)
+	if err != nil || delimiter == "" {
+		usageAndExit("Invalid -stream-delimiter.")
+	}
+	if *maxStreamDuration < 0 {
+		usageAndExit("-max-stream-duration cannot be smaller than 0.")
+	}
 	method := strings.ToUpper(*m)
 	dataType := strings.ToUpper(*dataType)
 
@@ -195,24 +564,157 @@ func main() {
 		requestParamSlice.RequestParams = append(requestParamSlice.RequestParams, param)
 	}
 	if *bodyFile != "" {
-		slurp, err := ioutil.ReadFile(*bodyFile)
+		rows, err := readRows(*bodyFile)
 		if err != nil {
 			errAndExit(err.Error())
 		}
-		bodyAll = slurp
+		requestParamSlice.RequestParams = append(requestParamSlice.RequestParams, rows...)
+	}
 
-		for _, row := range bytes.Split(bodyAll, []byte("\n")) {
-			if !bytes.Equal(row, []byte("")) {
-				param := requester.RequestParam{
-					Content: row,
-				}
-				requestParamSlice.RequestParams = append(requestParamSlice.RequestParams, param)
-			}
+	var groups []*requester.RequestGroup
+	for _, spec := range gs {
+		g, err := parseGroup(spec)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		groups = append(groups, g)
+	}
+	if len(groups) > 0 && (*once || *grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")) {
+		usageAndExit("-group only applies to HTTP requests and cannot be used with -once.")
+	}
+
+	if *once {
+		if len(requestParamSlice.RequestParams) == 0 {
+			usageAndExit("-once requires input rows from -d or -D.")
+		}
+		if *randomInput {
+			usageAndExit("-once cannot be used with -random-input.")
+		}
+	}
+
+	var outPath string
+	switch {
+	case strings.HasPrefix(*output, "html="), strings.HasPrefix(*output, "json="):
+		outPath = (*output)[len("html="):]
+		if outPath == "" {
+			usageAndExit(fmt.Sprintf("-o %s requires a file name.", (*output)[:len("html=")]))
 		}
+	case *output != "csv" && *output != "":
+		usageAndExit("Invalid output type; only csv, html=FILE and json=FILE are supported.")
+	}
+	if *timeSeriesInterval <= 0 {
+		usageAndExit("-timeseries-interval must be positive.")
 	}
 
-	if *output != "csv" && *output != "" {
-		usageAndExit("Invalid output type; only csv is supported.")
+	var retry *requester.RetryPolicy
+	if *retries < 0 {
+		usageAndExit("-retries cannot be negative.")
+	}
+	if *retries > 0 {
+		if *grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+			usageAndExit("-retries only applies to HTTP requests.")
+		}
+		retry = &requester.RetryPolicy{Max: *retries, On: strings.Split(*retryOn, ",")}
+		if err := parseBackoff(*backoff, retry); err != nil {
+			usageAndExit(err.Error())
+		}
+	}
+
+	if *dialTimeout < 0 || *tlsTimeout < 0 || *ttfbTimeout < 0 || *bodyTimeout < 0 || *hedgeDelay < 0 {
+		usageAndExit("Timeouts and -hedge-delay cannot be negative.")
+	}
+	if *hedge && (*grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")) {
+		usageAndExit("-hedge only applies to HTTP requests.")
+	}
+	if *hedgeDelay > 0 && !*hedge {
+		usageAndExit("-hedge-delay requires -hedge.")
+	}
+
+	var oauth2 *requester.OAuth2Config
+	if *oauth2TokenURL != "" {
+		if coordinate || *grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+			usageAndExit("-oauth2-token-url only applies to HTTP requests and cannot be used with coordinate.")
+		}
+		if *oauth2ClientID == "" {
+			usageAndExit("-oauth2-token-url requires -oauth2-client-id.")
+		}
+		if *authHeader != "" {
+			usageAndExit("-oauth2-token-url and -a cannot be used together.")
+		}
+		oauth2 = &requester.OAuth2Config{
+			TokenURL:     *oauth2TokenURL,
+			ClientID:     *oauth2ClientID,
+			ClientSecret: *oauth2ClientSecret,
+			Scopes:       strings.FieldsFunc(*oauth2Scope, func(r rune) bool { return r == ' ' || r == ',' }),
+		}
+	} else if *oauth2ClientID != "" || *oauth2ClientSecret != "" || *oauth2Scope != "" {
+		usageAndExit("-oauth2-client-id, -oauth2-client-secret and -oauth2-scope require -oauth2-token-url.")
+	}
+
+	var signer requester.Signer
+	if *sign != "" {
+		if coordinate || *grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+			usageAndExit("-sign only applies to HTTP requests and cannot be used with coordinate.")
+		}
+		var err error
+		if signer, err = parseSigner(*sign); err != nil {
+			usageAndExit(err.Error())
+		}
+	}
+
+	var jarCookies []requester.JarCookie
+	if *cookieFile != "" {
+		f, err := os.Open(*cookieFile)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		jarCookies, err = requester.LoadCookies(f)
+		f.Close()
+		if err != nil {
+			errAndExit(err.Error())
+		}
+	}
+	if *cookieReset && !*cookies && *cookieFile == "" {
+		usageAndExit("-cookie-reset requires -cookies or -cookie-file.")
+	}
+	if (*cookies || *cookieFile != "") && (*grpcMode || strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")) {
+		usageAndExit("-cookies and -cookie-file only apply to HTTP requests.")
+	}
+
+	var thinkTime *requester.ThinkTime
+	if *think != "" {
+		if *pacing > 0 {
+			usageAndExit("-think and -pacing cannot be used together.")
+		}
+		thinkTime = &requester.ThinkTime{}
+		if err := parseThink(*think, thinkTime); err != nil {
+			usageAndExit(err.Error())
+		}
+	}
+	if (*think != "" || *pacing > 0) && *async {
+		usageAndExit("-think and -pacing cannot be used with -async.")
+	}
+	if *pacing < 0 {
+		usageAndExit("-pacing cannot be negative.")
+	}
+
+	var capture *requester.Capture
+	if *captureFile != "" && *captureDir != "" {
+		usageAndExit("-capture and -capture-dir cannot be used together.")
+	}
+	if *captureFile != "" || *captureDir != "" {
+		if coordinate {
+			usageAndExit("-capture and -capture-dir cannot be used with coordinate.")
+		}
+		if *captureMaxBody <= 0 {
+			usageAndExit("-capture-max-body must be positive.")
+		}
+		capture = &requester.Capture{Dir: *captureDir, MaxBody: *captureMaxBody}
+		if err := parseCaptureSample(*captureSample, capture); err != nil {
+			usageAndExit(err.Error())
+		}
+	} else if *captureSample != "" {
+		usageAndExit("-capture-sample requires -capture or -capture-dir.")
 	}
 
 	var proxyURL *gourl.URL
@@ -246,39 +748,263 @@ func main() {
 		N:                    num,
 		C:                    conc,
 		QPS:                  qps,
+		Burst:                *burst,
 		SingleRequestTimeout: time.Duration(*T) * time.Second,
+		DialTimeout:          *dialTimeout,
+		TLSTimeout:           *tlsTimeout,
+		FirstByteTimeout:     *ttfbTimeout,
+		BodyTimeout:          *bodyTimeout,
+		Hedge:                *hedge,
+		HedgeDelay:           *hedgeDelay,
 		PerformanceTimeout:   time.Duration(*t) * time.Second,
 		DisableOutput:        *disableOutput,
 		DisableCompression:   *disableCompression,
 		DisableKeepAlives:    *disableKeepAlives,
 		DisableRedirects:     *disableRedirects,
+		CookieJar:            *cookies,
+		Cookies:              jarCookies,
+		ResetCookies:         *cookieReset,
 		RandomInput:          *randomInput,
+		Once:                 *once,
+		Retry:                retry,
+		OAuth2:               oauth2,
+		Signer:               signer,
+		TestName:             *testName,
+		TagField:             *tagField,
 		Async:                *async,
-		H2:                   *h2,
+		Groups:               groups,
+		Think:                thinkTime,
+		Pacing:               *pacing,
+		H2:                   *h2 || *h2c,
+		H2C:                  *h2c,
+		H2Conns:              *h2Conns,
+		H2StreamsPerConn:     *h2StreamsPerConn,
+		H3:                   *h3,
+		H3ZeroRTT:            *h3ZeroRTT,
+		WSIDField:            *wsIDField,
+		Stream:               *stream,
+		StreamDelimiter:      delimiter,
+		MaxStreamDuration:    *maxStreamDuration,
+		GRPC:                 *grpcMode,
+		GRPCCall:             *grpcCall,
+		GRPCProto:            *grpcProto,
 		ProxyAddr:            proxyURL,
-		Output:               *output,
+		GracePeriod:          time.Duration(*grace) * time.Second,
+		Renderer:             &requester.TextRenderer{W: os.Stdout, CSV: *output == "csv"},
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	var outFiles []*os.File
+	create := func(path string) *os.File {
+		f, err := os.Create(path)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		outFiles = append(outFiles, f)
+		return f
+	}
+	if capture != nil {
+		if *captureFile != "" {
+			capture.W = create(*captureFile)
+		}
+		w.Capture = capture
+	}
+	renderers := requester.MultiRenderer{w.Renderer}
+	if outPath != "" {
+		if strings.HasPrefix(*output, "json=") {
+			renderers = append(renderers, &requester.JSONRenderer{W: create(outPath)})
+		} else {
+			renderers = append(renderers, &requester.HTMLRenderer{W: create(outPath)})
+		}
+	}
+	if *timeSeries != "" {
+		renderers = append(renderers, &requester.TimeSeriesRenderer{
+			W:        create(*timeSeries),
+			Interval: time.Duration(*timeSeriesInterval * float64(time.Second)),
+			JSON:     strings.HasSuffix(*timeSeries, ".jsonl"),
+		})
+	}
+	if len(renderers) > 1 {
+		w.Renderer = renderers
+	}
+
+	if *influxURL != "" {
+		w.Sinks = append(w.Sinks, &requester.InfluxSink{URL: *influxURL, Token: *influxToken, Test: *testName})
+	}
+	if *otlpURL != "" {
+		w.Sinks = append(w.Sinks, &requester.OTLPSink{URL: *otlpURL, Test: *testName})
+	}
+	if *statsdAddr != "" {
+		w.Sinks = append(w.Sinks, &requester.StatsdSink{Addr: *statsdAddr})
+	}
+
+	if *metricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		w.Metrics = requester.NewMetrics(reg)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				errAndExit(err.Error())
+			}
+		}()
+	}
+
+	// The first signal stops sending and lets in-flight requests complete,
+	// a second one gives up on them.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		w.Finish()
+		fmt.Fprintf(os.Stderr, "\nStopping, waiting up to %ds for in-flight requests. Press Ctrl-C again to exit now.\n", *grace)
+		cancel()
+		<-c
 		os.Exit(1)
 	}()
 
-	w.Run()
+	if coordinate {
+		co := &requester.Coordinator{
+			Agents: strings.Split(*agents, ","),
+			Work:   w,
+			Token:  *agentToken,
+		}
+		_, err = co.Run(ctx)
+	} else {
+		_, err = w.Run(ctx)
+	}
+	for _, f := range outFiles {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		errAndExit(err.Error())
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// runAgent serves load tests to a coordinator until killed.
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	listen := fs.String("listen", "127.0.0.1:7000", "")
+	fs.StringVar(agentToken, "token", "", "")
+	fs.StringVar(logFile, "log-file", "", "")
+	fs.StringVar(logLevel, "log-level", "", "")
+	fs.StringVar(logFormat, "log-format", "", "")
+	fs.Parse(args)
+	setupLogging()
+	if *agentToken == "" && !isLoopback(*listen) {
+		usageAndExit("agent requires -token unless it listens on a loopback address.")
+	}
+
+	fmt.Fprintf(os.Stderr, "meg_sender agent listening on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, &requester.Agent{Token: *agentToken}); err != nil {
+		errAndExit(err.Error())
+	}
+}
+
+// isLoopback reports whether addr only listens on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// runCompare compares two saved runs and exits with status 1 on a
+// regression.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	latencyTolerance := fs.Float64("latency-tolerance", 10, "")
+	rpsTolerance := fs.Float64("rps-tolerance", 10, "")
+	errorTolerance := fs.Float64("error-tolerance", 1, "")
+	alpha := fs.Float64("alpha", 0.05, "")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usageAndExit("compare requires a baseline and a current result file.")
+	}
+	if *latencyTolerance < 0 || *rpsTolerance < 0 || *errorTolerance < 0 {
+		usageAndExit("Tolerances cannot be negative.")
+	}
+	if *alpha <= 0 || *alpha >= 1 {
+		usageAndExit("-alpha must be between 0 and 1.")
+	}
+
+	var reps [2]*requester.Report
+	for i, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		reps[i], err = requester.LoadReport(f)
+		f.Close()
+		if err != nil {
+			errAndExit(fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+	c := requester.Compare(reps[0], reps[1], requester.Tolerance{
+		Latency:   *latencyTolerance / 100,
+		RPS:       *rpsTolerance / 100,
+		ErrorRate: *errorTolerance / 100,
+		Alpha:     *alpha,
+	})
+	if err := c.Print(os.Stdout); err != nil {
+		errAndExit(err.Error())
+	}
+	if len(c.Regressions) > 0 {
+		os.Exit(1)
+	}
+}
+
+// setupLogging routes the requester's logs as set by the -log flags. The
+// log file is never closed, it is written until the process exits.
+func setupLogging() {
+	if *logFile == "" && *logLevel == "" && *logFormat == "" {
+		// The package is silent by default: print the responses and
+		// warnings to stdout and the errors to stderr.
+		requester.Info.SetOutput(os.Stdout)
+		requester.Warning.SetOutput(os.Stdout)
+		requester.Error.SetOutput(os.Stderr)
+		return
+	}
+	var level slog.Level
+	if *logLevel != "" {
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			usageAndExit("Invalid -log-level; use debug, info, warn or error.")
+		}
+	}
+	if *logFormat != "" && *logFormat != "text" && *logFormat != "json" {
+		usageAndExit("Invalid -log-format; use text or json.")
+	}
+	out := io.Writer(os.Stderr)
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		out = f
+	}
+	requester.SetLogger(requester.NewLogger(out, level, *logFormat == "json"))
 }
 
 func errAndExit(msg string) {
-	fmt.Fprintf(os.Stderr, msg)
+	fmt.Fprint(os.Stderr, msg)
 	fmt.Fprintf(os.Stderr, "\n")
 	os.Exit(1)
 }
 
 func usageAndExit(msg string) {
 	if msg != "" {
-		fmt.Fprintf(os.Stderr, msg)
+		fmt.Fprint(os.Stderr, msg)
 		fmt.Fprintf(os.Stderr, "\n\n")
 	}
 	flag.Usage()
@@ -295,6 +1021,243 @@ func parseInputWithRegexp(input, regx string) ([]string, error) {
 	return matches, nil
 }
 
+// parseBackoff sets the backoff of p from "exp:MIN..MAX" or "const:WAIT".
+func parseBackoff(s string, p *requester.RetryPolicy) error {
+	kind, waits, _ := strings.Cut(s, ":")
+	var err error
+	switch kind {
+	case "exp":
+		min, max, ok := strings.Cut(waits, "..")
+		if !ok {
+			return fmt.Errorf("-backoff exp needs MIN..MAX, e.g. exp:50ms..2s.")
+		}
+		p.Exponential = true
+		if p.Backoff, err = time.ParseDuration(min); err == nil {
+			p.MaxBackoff, err = time.ParseDuration(max)
+		}
+		if err == nil && p.MaxBackoff < p.Backoff {
+			return fmt.Errorf("-backoff maximum cannot be less than the minimum.")
+		}
+	case "const":
+		p.Backoff, err = time.ParseDuration(waits)
+	default:
+		return fmt.Errorf("Invalid -backoff %q; use exp:MIN..MAX or const:WAIT.", s)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid -backoff %q: %v", s, err)
+	}
+	return nil
+}
+
+// parseSigner returns the signer named by -sign, configured by the other
+// -sign and -jwt flags.
+func parseSigner(s string) (requester.Signer, error) {
+	key := []byte(*signKey)
+	if strings.HasPrefix(*signKey, "@") {
+		var err error
+		if key, err = ioutil.ReadFile((*signKey)[1:]); err != nil {
+			return nil, err
+		}
+	}
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "hmac":
+		if len(key) == 0 {
+			return nil, fmt.Errorf("-sign hmac requires -sign-key.")
+		}
+		canonical := strings.ReplaceAll(*signCanonical, `\n`, "\n")
+		return &requester.HMACSigner{Key: key, Canonical: canonical, Header: *signHeader, TimestampHeader: "X-Timestamp"}, nil
+	case "sigv4":
+		region, service, ok := strings.Cut(arg, "/")
+		if !ok || region == "" || service == "" {
+			return nil, fmt.Errorf("-sign sigv4 needs REGION/SERVICE, e.g. sigv4:us-east-1/execute-api.")
+		}
+		signer := &requester.SigV4Signer{
+			AccessKey:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:     os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:  os.Getenv("AWS_SESSION_TOKEN"),
+			Region:        region,
+			Service:       service,
+			ContentSHA256: service == "s3",
+		}
+		if signer.AccessKey == "" || signer.SecretKey == "" {
+			return nil, fmt.Errorf("-sign sigv4 requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+		}
+		return signer, nil
+	case "jwt":
+		if arg != "HS256" && arg != "RS256" {
+			return nil, fmt.Errorf("-sign jwt needs HS256 or RS256, e.g. jwt:HS256.")
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("-sign jwt requires -sign-key.")
+		}
+		if *jwtTTL <= 0 {
+			return nil, fmt.Errorf("-jwt-ttl must be positive.")
+		}
+		perRequest := strings.Contains(*jwtClaims, ".Nonce") || strings.Contains(*jwtClaims, ".Body") ||
+			strings.Contains(*jwtClaims, ".Path") || strings.Contains(*jwtClaims, ".Query") || strings.Contains(*jwtClaims, ".Header")
+		return &requester.JWTSigner{Alg: arg, Key: key, Claims: *jwtClaims, TTL: *jwtTTL, PerRequest: perRequest, Header: *signHeader}, nil
+	}
+	return nil, fmt.Errorf("Invalid -sign %q; use hmac, sigv4:REGION/SERVICE, jwt:HS256 or jwt:RS256.", s)
+}
+
+// readRows reads the input rows of a -D file, one per non-empty line.
+func readRows(path string) ([]requester.RequestParam, error) {
+	slurp, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []requester.RequestParam
+	for _, row := range bytes.Split(slurp, []byte("\n")) {
+		if !bytes.Equal(row, []byte("")) {
+			rows = append(rows, requester.RequestParam{Content: row})
+		}
+	}
+	return rows, nil
+}
+
+// parseGroup returns the request group described by comma-separated
+// key=value pairs such as "name=search,weight=70,m=POST,D=search.txt".
+func parseGroup(s string) (*requester.RequestGroup, error) {
+	g := &requester.RequestGroup{}
+	for _, opt := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("Invalid -group %q; use key=value pairs.", s)
+		}
+		switch key {
+		case "name":
+			g.Name = value
+		case "weight":
+			w, err := strconv.Atoi(value)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("-group weight needs a positive number.")
+			}
+			g.Weight = w
+		case "url":
+			g.URL = value
+		case "m":
+			g.Method = strings.ToUpper(value)
+		case "f":
+			g.DataType = value
+		case "D":
+			rows, err := readRows(value)
+			if err != nil {
+				return nil, err
+			}
+			g.RequestParamSlice = &requester.RequestParamSlice{RequestParams: rows}
+		default:
+			return nil, fmt.Errorf("Invalid -group key %q; use name, weight, url, m, D or f.", key)
+		}
+	}
+	if g.Name == "" || g.Weight == 0 {
+		return nil, fmt.Errorf("-group %q needs a name and a weight.", s)
+	}
+	return g, nil
+}
+
+// parseThink sets t from "WAIT", "MIN..MAX", "normal:MEAN,STDDEV" or
+// "exp:MEAN".
+func parseThink(s string, t *requester.ThinkTime) error {
+	kind, waits, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, waits = "", s
+	}
+	var err error
+	switch kind {
+	case "":
+		min, max, uniform := strings.Cut(waits, "..")
+		if t.Min, err = time.ParseDuration(min); err != nil {
+			break
+		}
+		t.Dist = "constant"
+		if uniform {
+			t.Dist = "uniform"
+			if t.Max, err = time.ParseDuration(max); err == nil && t.Max < t.Min {
+				return fmt.Errorf("-think maximum cannot be less than the minimum.")
+			}
+		}
+	case "normal":
+		mean, stddev, ok := strings.Cut(waits, ",")
+		if !ok {
+			return fmt.Errorf("-think normal needs MEAN,STDDEV, e.g. normal:500ms,100ms.")
+		}
+		t.Dist = "normal"
+		if t.Mean, err = time.ParseDuration(mean); err == nil {
+			t.StdDev, err = time.ParseDuration(stddev)
+		}
+	case "exp":
+		t.Dist = "exponential"
+		t.Mean, err = time.ParseDuration(waits)
+	default:
+		return fmt.Errorf("Invalid -think %q; use WAIT, MIN..MAX, normal:MEAN,STDDEV or exp:MEAN.", s)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid -think %q: %v", s, err)
+	}
+	if t.Min < 0 || t.Max < 0 || t.Mean < 0 || t.StdDev < 0 {
+		return fmt.Errorf("-think cannot be negative.")
+	}
+	return nil
+}
+
+// parseCaptureSample sets the sampling of c from a comma-separated list
+// such as "non-2xx,first=100".
+func parseCaptureSample(s string, c *requester.Capture) error {
+	if s == "" {
+		return nil
+	}
+	for _, opt := range strings.Split(s, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(opt), "=")
+		var n int
+		if hasValue {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+				return fmt.Errorf("-capture-sample %s needs a positive number.", name)
+			}
+		}
+		switch {
+		case name == "errors" && !hasValue:
+			c.ErrorsOnly = true
+		case name == "non-2xx" && !hasValue:
+			c.Non2xx = true
+		case name == "every" && hasValue:
+			c.Every = n
+		case name == "first" && hasValue:
+			c.First = n
+		case name == "slowest" && hasValue:
+			c.Slowest = n
+		default:
+			return fmt.Errorf("Invalid -capture-sample %q; use errors, non-2xx, every=N, first=N or slowest=N.", opt)
+		}
+	}
+	return nil
+}
+
+// parseDelimiter replaces the Go escapes in s, such as \n or \x00, with the
+// characters they stand for. Quotes are taken as they are.
+func parseDelimiter(s string) (string, error) {
+	var b strings.Builder
+	for s != "" {
+		if s[0] == '"' {
+			b.WriteByte('"')
+			s = s[1:]
+			continue
+		}
+		c, multibyte, tail, err := strconv.UnquoteChar(s, '"')
+		if err != nil {
+			return "", err
+		}
+		if c < utf8.RuneSelf || multibyte {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte(byte(c))
+		}
+		s = tail
+	}
+	return b.String(), nil
+}
+
 type headerSlice []string
 
 func (h *headerSlice) String() string {
@@ -15,7 +15,12 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/alex19861108/meg-sender/requester"
 )
 
 func TestParseValidHeaderFlag(t *testing.T) {
@@ -58,3 +63,129 @@ func TestParseAuthMetaCharacters(t *testing.T) {
 		t.Errorf("Could not parse an auth header with a plus sign in the user name")
 	}
 }
+
+func TestParseCaptureSample(t *testing.T) {
+	var c requester.Capture
+	if err := parseCaptureSample("non-2xx, first=10,slowest=3", &c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Non2xx || c.ErrorsOnly || c.First != 10 || c.Slowest != 3 || c.Every != 0 {
+		t.Errorf("Sampling was not parsed correctly, found non-2xx %v, errors %v, first %d, slowest %d, every %d",
+			c.Non2xx, c.ErrorsOnly, c.First, c.Slowest, c.Every)
+	}
+	for _, bad := range []string{"every", "every=0", "first=x", "errors=1", "sometimes"} {
+		if err := parseCaptureSample(bad, &requester.Capture{}); err == nil {
+			t.Errorf("An invalid sampling %q passed parsing", bad)
+		}
+	}
+}
+
+func TestParseBackoff(t *testing.T) {
+	var p requester.RetryPolicy
+	if err := parseBackoff("exp:50ms..2s", &p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Exponential || p.Backoff != 50*time.Millisecond || p.MaxBackoff != 2*time.Second {
+		t.Errorf("Backoff was not parsed correctly, found %+v", p)
+	}
+	p = requester.RetryPolicy{}
+	if err := parseBackoff("const:100ms", &p); err != nil || p.Exponential || p.Backoff != 100*time.Millisecond {
+		t.Errorf("Constant backoff was not parsed correctly, found %+v, %v", p, err)
+	}
+	for _, bad := range []string{"exp:50ms", "exp:2s..50ms", "const:soon", "linear:1s"} {
+		if err := parseBackoff(bad, &requester.RetryPolicy{}); err == nil {
+			t.Errorf("An invalid backoff %q passed parsing", bad)
+		}
+	}
+}
+
+func TestParseThink(t *testing.T) {
+	tests := []struct {
+		in   string
+		want requester.ThinkTime
+	}{
+		{"500ms", requester.ThinkTime{Dist: "constant", Min: 500 * time.Millisecond}},
+		{"200ms..1s", requester.ThinkTime{Dist: "uniform", Min: 200 * time.Millisecond, Max: time.Second}},
+		{"normal:500ms,100ms", requester.ThinkTime{Dist: "normal", Mean: 500 * time.Millisecond, StdDev: 100 * time.Millisecond}},
+		{"exp:2s", requester.ThinkTime{Dist: "exponential", Mean: 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		var th requester.ThinkTime
+		if err := parseThink(tt.in, &th); err != nil || th != tt.want {
+			t.Errorf("Think time %q was not parsed correctly, found %+v, %v", tt.in, th, err)
+		}
+	}
+	for _, bad := range []string{"soon", "1s..200ms", "normal:500ms", "exp:-1s", "poisson:1s"} {
+		if err := parseThink(bad, &requester.ThinkTime{}); err == nil {
+			t.Errorf("An invalid think time %q passed parsing", bad)
+		}
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := map[string]string{
+		`\n\n`:      "\n\n",
+		`"}\n`:      "\"}\n",
+		`\"end\"`:   `"end"`,
+		`\x00é\xff`: "\x00é\xff",
+	}
+	for in, want := range tests {
+		if got, err := parseDelimiter(in); err != nil || got != want {
+			t.Errorf("Delimiter %s was not parsed correctly, found %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseDelimiter(`\q`); err == nil {
+		t.Errorf("An invalid escape passed parsing")
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rows.txt")
+	if err := os.WriteFile(path, []byte("a\n\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := parseGroup("name=search,weight=70,m=post,url=http://host/search,f=JSON,D=" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Name != "search" || g.Weight != 70 || g.Method != "POST" || g.URL != "http://host/search" || g.DataType != "JSON" {
+		t.Errorf("Group was not parsed correctly, found %+v", g)
+	}
+	if rows := g.RequestParamSlice.RequestParams; len(rows) != 2 || string(rows[1].Content) != "b" {
+		t.Errorf("Expected the 2 rows of the group's file, found %v", rows)
+	}
+	for _, bad := range []string{"name=search", "weight=1", "name=a,weight=0", "name=a,weight=1,x=y", "name=a,weight"} {
+		if _, err := parseGroup(bad); err == nil {
+			t.Errorf("An invalid group %q passed parsing", bad)
+		}
+	}
+}
+
+func TestParseSigner(t *testing.T) {
+	key, canonical, header, claims, ttl := *signKey, *signCanonical, *signHeader, *jwtClaims, *jwtTTL
+	t.Cleanup(func() {
+		*signKey, *signCanonical, *signHeader, *jwtClaims, *jwtTTL = key, canonical, header, claims, ttl
+	})
+
+	*signKey, *signCanonical = "secret", `{{.Method}}\n{{.Path}}`
+	s, err := parseSigner("hmac")
+	if h, ok := s.(*requester.HMACSigner); err != nil || !ok || string(h.Key) != "secret" || h.Canonical != "{{.Method}}\n{{.Path}}" {
+		t.Errorf("HMAC signer was not parsed correctly, found %+v, %v", s, err)
+	}
+	*jwtClaims = `{"jti":"{{.Nonce}}"}`
+	s, err = parseSigner("jwt:HS256")
+	if j, ok := s.(*requester.JWTSigner); err != nil || !ok || j.Alg != "HS256" || !j.PerRequest || j.TTL != time.Hour {
+		t.Errorf("JWT signer was not parsed correctly, found %+v, %v", s, err)
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "key")
+	s, err = parseSigner("sigv4:eu-west-1/s3")
+	if v, ok := s.(*requester.SigV4Signer); err != nil || !ok || v.Region != "eu-west-1" || !v.ContentSHA256 {
+		t.Errorf("SigV4 signer was not parsed correctly, found %+v, %v", s, err)
+	}
+	for _, bad := range []string{"sigv4:eu-west-1", "jwt:ES256", "rsa"} {
+		if _, err := parseSigner(bad); err == nil {
+			t.Errorf("An invalid signer %q passed parsing", bad)
+		}
+	}
+}
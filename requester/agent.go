@@ -0,0 +1,288 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plan is the test definition a coordinator ships to its agents.
+type plan struct {
+	Work
+	Request requestSpec
+}
+
+// requestSpec is the wire form of the request template.
+type requestSpec struct {
+	Method string
+	URL    string
+	Header http.Header
+	Host   string
+}
+
+// startSpec tells the agents when to start, so that they all start at once.
+type startSpec struct {
+	StartAt time.Time
+}
+
+// snapshot is the wire form of an agent's report. The raw latencies are
+// shipped so that the merged histogram and percentiles are exact.
+type snapshot struct {
+	StartTime      time.Time
+	TimeUsed       time.Duration
+	Lats           []float64
+	Starts         []float64
+	Codes          []int
+	ErrStarts      []float64
+	ConnLats       []float64
+	DNSLats        []float64
+	TLSLats        []float64
+	ReqLats        []float64
+	DelayLats      []float64
+	ResLats        []float64
+	StatusCodeDist map[int]int
+	ErrorDist      map[string]int
+	SizeTotal      int64
+	GRPC           bool
+	Retries        *RetryStats
+	Hedges         *HedgeStats
+	Think          *ThinkStats
+	Groups         map[string]*groupStats
+	Token          *TokenStats
+}
+
+func (r *report) snapshot() *snapshot {
+	return &snapshot{
+		StartTime:      r.startTime,
+		TimeUsed:       r.timeUsed,
+		Lats:           r.lats,
+		Starts:         r.starts,
+		Codes:          r.codes,
+		ErrStarts:      r.errStarts,
+		ConnLats:       r.connLats,
+		DNSLats:        r.dnsLats,
+		TLSLats:        r.tlsLats,
+		ReqLats:        r.reqLats,
+		DelayLats:      r.delayLats,
+		ResLats:        r.resLats,
+		StatusCodeDist: r.statusCodeDist,
+		ErrorDist:      r.errorDist,
+		SizeTotal:      r.sizeTotal,
+		GRPC:           r.grpc,
+		Retries:        r.retries,
+		Hedges:         r.hedges,
+		Think:          r.think,
+		Groups:         r.groups,
+		Token:          r.token,
+	}
+}
+
+// Agent runs load tests on behalf of a coordinator. It serves a small JSON
+// API: POST /prepare with the test definition, POST /start with the start
+// time, then GET /result, which blocks until the run is over. POST /stop
+// cancels the run, whose result then covers the requests completed so far,
+// and POST /reset also drops the test so that the agent is free for the
+// next one. An agent runs one test at a time; a finished test whose result
+// was not collected is dropped by the next /prepare.
+//
+// A test tells the agent where to send requests and which local files to
+// read, so the agent must only be reachable by its coordinator. If Token is
+// set, every call must carry it as a bearer token.
+type Agent struct {
+	Token string
+
+	mu     sync.Mutex
+	work   *Work
+	done   chan struct{}
+	cancel context.CancelFunc // cancels the running test
+	result *snapshot
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Debug.Printf("%s from %s\n", r.URL.Path, r.RemoteAddr)
+	if !a.authorized(r) {
+		Warning.Printf("agent: unauthorized %s from %s\n", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	switch r.URL.Path {
+	case "/prepare":
+		err = a.prepare(r)
+	case "/start":
+		err = a.start(r)
+	case "/stop":
+		err = a.stop()
+	case "/reset":
+		a.reset()
+	case "/result":
+		var snap *snapshot
+		snap, err = a.wait(r)
+		if err == nil {
+			json.NewEncoder(w).Encode(snap)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		Error.Println(err)
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// authorized reports whether r carries the Token, if one is set.
+func (a *Agent) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(a.Token)) == 1
+}
+
+func (a *Agent) prepare(r *http.Request) error {
+	var p plan
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(p.Request.Method, p.Request.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = p.Request.Header
+	req.Host = p.Request.Host
+	p.Work.Request = req
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done != nil {
+		select {
+		case <-a.done:
+			// Nobody collected the result of the last test.
+			a.clear()
+		default:
+			return errors.New("agent is busy with another test")
+		}
+	}
+	a.work = &p.Work
+	return nil
+}
+
+func (a *Agent) start(r *http.Request) error {
+	var s startSpec
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.work == nil || a.done != nil {
+		return errors.New("agent has no prepared test")
+	}
+	w, done := a.work, make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	a.done, a.cancel = done, cancel
+	go func() {
+		select {
+		case <-time.After(s.StartAt.Sub(time.Now())):
+		case <-ctx.Done():
+		}
+		_, err := w.Run(ctx)
+		if err != nil {
+			Error.Println(err)
+		}
+		a.mu.Lock()
+		if err == nil && a.done == done {
+			a.result = w.report.snapshot()
+		}
+		a.mu.Unlock()
+		close(done)
+	}()
+	return nil
+}
+
+// stop cancels the running test.
+func (a *Agent) stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancel == nil {
+		return errors.New("agent has no running test")
+	}
+	a.cancel()
+	return nil
+}
+
+// reset cancels the running test, if any, waits for it to end and drops
+// it.
+func (a *Agent) reset() {
+	a.mu.Lock()
+	done := a.done
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done == done {
+		a.clear()
+	}
+}
+
+// clear drops the test. a.mu must be held.
+func (a *Agent) clear() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.work, a.done, a.cancel, a.result = nil, nil, nil, nil
+}
+
+// wait blocks until the running test is over and returns its report. Only
+// one caller gets the report.
+func (a *Agent) wait(r *http.Request) (*snapshot, error) {
+	a.mu.Lock()
+	done := a.done
+	a.mu.Unlock()
+	if done == nil {
+		return nil, errors.New("agent has no running test")
+	}
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done != done {
+		return nil, errors.New("the result was collected by another call")
+	}
+	snap := a.result
+	a.clear()
+	if snap == nil {
+		return nil, errors.New("test failed to run, see the agent log")
+	}
+	return snap, nil
+}
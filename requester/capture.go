@@ -0,0 +1,212 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultCaptureMaxBody is the number of body bytes captured when
+// Capture.MaxBody is zero.
+const DefaultCaptureMaxBody = 4096
+
+// Capture saves a sample of the responses, as JSON lines to W or as one
+// JSON file per response in Dir. ErrorsOnly and Non2xx restrict which
+// responses are eligible; Every, First and Slowest then pick among them.
+// With Slowest, the responses are written once the test is over.
+type Capture struct {
+	// W receives the responses as JSON lines. It is ignored if Dir is set.
+	W io.Writer
+
+	// Dir receives every response in its own file, named after its
+	// sequence number and status code. It is created if needed.
+	Dir string
+
+	// ErrorsOnly captures only the requests that failed without a
+	// response and the gRPC calls that failed.
+	ErrorsOnly bool
+
+	// Non2xx captures only failed requests and responses whose status
+	// code is not 2xx, or not OK for gRPC.
+	Non2xx bool
+
+	// Every captures every Every-th eligible response.
+	Every int
+
+	// First captures the first First eligible responses.
+	First int
+
+	// Slowest captures the Slowest slowest eligible responses.
+	Slowest int
+
+	// MaxBody is the number of body bytes captured, the rest is cut off.
+	// Default is DefaultCaptureMaxBody.
+	MaxBody int
+
+	mu      sync.Mutex
+	seen    int // eligible responses
+	written int
+	slowest []*CapturedResponse
+	bw      *bufio.Writer
+	err     error // first write error
+}
+
+// CapturedResponse is a captured request with its response.
+type CapturedResponse struct {
+	Time          time.Time   `json:"time"`
+	Input         string      `json:"input,omitempty"`
+	Method        string      `json:"method,omitempty"`
+	URL           string      `json:"url,omitempty"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header,omitempty"`
+	Error         string      `json:"error,omitempty"`
+	Duration      float64     `json:"duration"` // seconds
+	Body          string      `json:"body"`
+	Truncated     bool        `json:"truncated,omitempty"`
+}
+
+func (c *Capture) maxBody() int {
+	if c.MaxBody <= 0 {
+		return DefaultCaptureMaxBody
+	}
+	return c.MaxBody
+}
+
+// want reports whether a response, successful if ok is set, or a failed
+// request if err is set, may be captured. It is cheap enough to decide
+// whether to read the body at all, and false for a nil Capture.
+func (c *Capture) want(ok bool, err error) bool {
+	if c == nil {
+		return false
+	}
+	if c.ErrorsOnly && err == nil {
+		return false
+	}
+	if c.Non2xx && err == nil && ok {
+		return false
+	}
+	if c.First > 0 && c.Slowest == 0 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.seen < c.First
+	}
+	return true
+}
+
+// add captures r if the sampling picks it. r must have passed want.
+func (c *Capture) add(r *CapturedResponse) {
+	if max := c.maxBody(); len(r.Body) > max {
+		// Cut before a character that does not fit whole, unless the
+		// body is no text.
+		n := max
+		for n > 0 && max-n < utf8.UTFMax-1 && !utf8.RuneStart(r.Body[n]) {
+			n--
+		}
+		if utf8.RuneStart(r.Body[n]) {
+			max = n
+		}
+		r.Body = r.Body[:max]
+		r.Truncated = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen++
+	if c.Every > 0 && (c.seen-1)%c.Every != 0 {
+		return
+	}
+	if c.First > 0 && c.seen > c.First {
+		return
+	}
+	if c.Slowest == 0 {
+		c.write(r)
+		return
+	}
+	if len(c.slowest) < c.Slowest {
+		c.slowest = append(c.slowest, r)
+		return
+	}
+	fastest := 0
+	for i, s := range c.slowest {
+		if s.Duration < c.slowest[fastest].Duration {
+			fastest = i
+		}
+	}
+	if r.Duration > c.slowest[fastest].Duration {
+		c.slowest[fastest] = r
+	}
+}
+
+// write saves r. c.mu must be held.
+func (c *Capture) write(r *CapturedResponse) {
+	if c.err != nil {
+		return
+	}
+	c.written++
+	if c.Dir != "" {
+		name := fmt.Sprintf("%06d-%d.json", c.written, r.Status)
+		if r.Error != "" {
+			name = fmt.Sprintf("%06d-error.json", c.written)
+		}
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err == nil {
+			if err = os.MkdirAll(c.Dir, 0755); err == nil {
+				err = ioutil.WriteFile(filepath.Join(c.Dir, name), data, 0644)
+			}
+		}
+		c.err = err
+		return
+	}
+	if c.bw == nil {
+		c.bw = bufio.NewWriter(c.W)
+	}
+	c.err = json.NewEncoder(c.bw).Encode(r)
+}
+
+// flush writes the slowest responses and whatever is still buffered, and
+// returns the first error writing the responses.
+func (c *Capture) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sort.Slice(c.slowest, func(i, j int) bool { return c.slowest[i].Duration > c.slowest[j].Duration })
+	for _, r := range c.slowest {
+		c.write(r)
+	}
+	c.slowest = nil
+	if c.bw != nil && c.err == nil {
+		c.err = c.bw.Flush()
+	}
+	return c.err
+}
+
+// printResponses reports whether responses are printed to Info, which they
+// are if Info writes somewhere, unless disabled or captured instead.
+func (b *Work) printResponses() bool {
+	return !b.DisableOutput && b.Capture == nil && Info.Writer() != io.Discard
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// JSONRenderer saves the raw results of a test as JSON, to be loaded again
+// with LoadReport, e.g. to compare two runs.
+type JSONRenderer struct {
+	W io.Writer
+}
+
+func (j *JSONRenderer) Render(rep *Report) error {
+	return json.NewEncoder(j.W).Encode(rep.r.snapshot())
+}
+
+// LoadReport reads results saved by JSONRenderer.
+func LoadReport(rd io.Reader) (*Report, error) {
+	var s snapshot
+	if err := json.NewDecoder(rd).Decode(&s); err != nil {
+		return nil, err
+	}
+	r := newReport(nil, nil)
+	r.merge(&s)
+	r.calculate()
+	return r.summary(), nil
+}
+
+// Tolerance is how much worse a run may be than its baseline before it
+// counts as a regression.
+type Tolerance struct {
+	// Latency is the allowed relative increase of each latency
+	// percentile, e.g. 0.1 for 10%. The increase is a regression only if
+	// the latency distributions also differ significantly.
+	Latency float64
+
+	// RPS is the allowed relative decrease of the requests per second.
+	RPS float64
+
+	// ErrorRate is the allowed absolute increase of the share of failed
+	// requests, e.g. 0.01 for one percentage point.
+	ErrorRate float64
+
+	// Alpha is the significance level of the latency test. Default is 0.05.
+	Alpha float64
+}
+
+// Comparison is the difference between a run and its baseline.
+type Comparison struct {
+	Rows []ComparisonRow
+
+	// P is the p-value of the Mann-Whitney U test that the response times
+	// of both runs come from the same distribution.
+	P float64
+
+	// Slower is set if the current run's response times tend to be larger.
+	Slower bool
+
+	// Regressions describes every metric beyond its tolerance.
+	Regressions []string
+}
+
+// ComparisonRow compares one metric of both runs. Latencies are in
+// seconds and error rates are fractions.
+type ComparisonRow struct {
+	Metric   string
+	Baseline float64
+	Current  float64
+	Unit     string
+}
+
+// Delta returns the absolute and relative change of the metric. The
+// relative change is NaN if the baseline is zero.
+func (c ComparisonRow) Delta() (abs, rel float64) {
+	abs = c.Current - c.Baseline
+	if c.Baseline == 0 {
+		return abs, math.NaN()
+	}
+	return abs, abs / c.Baseline
+}
+
+// Compare compares the current run with the baseline.
+func Compare(base, cur *Report, tol Tolerance) *Comparison {
+	if tol.Alpha == 0 {
+		tol.Alpha = 0.05
+	}
+	c := &Comparison{}
+	var z float64
+	c.P, z = mannWhitney(cur.r.lats, base.r.lats)
+	c.Slower = z > 0
+	significant := c.Slower && c.P < tol.Alpha
+
+	for i, p := range cur.Latencies {
+		if i >= len(base.Latencies) {
+			break
+		}
+		row := ComparisonRow{fmt.Sprintf("p%d", p.P), base.Latencies[i].Latency.Seconds(), p.Latency.Seconds(), "secs"}
+		c.Rows = append(c.Rows, row)
+		if _, rel := row.Delta(); significant && rel > tol.Latency {
+			c.Regressions = append(c.Regressions, fmt.Sprintf("%s is %.1f%% slower, more than the %.1f%% allowed", row.Metric, rel*100, tol.Latency*100))
+		}
+	}
+	c.Rows = append(c.Rows, ComparisonRow{"Average", base.Average.Seconds(), cur.Average.Seconds(), "secs"})
+
+	rps := ComparisonRow{"Requests/sec", base.RPS, cur.RPS, ""}
+	c.Rows = append(c.Rows, rps)
+	if _, rel := rps.Delta(); rel < -tol.RPS {
+		c.Regressions = append(c.Regressions, fmt.Sprintf("Requests/sec dropped by %.1f%%, more than the %.1f%% allowed", -rel*100, tol.RPS*100))
+	}
+
+	errs := ComparisonRow{"Error rate", errorRate(base), errorRate(cur), "%"}
+	c.Rows = append(c.Rows, errs)
+	if abs, _ := errs.Delta(); abs > tol.ErrorRate {
+		c.Regressions = append(c.Regressions, fmt.Sprintf("Error rate rose by %.2f points, more than the %.2f allowed", abs*100, tol.ErrorRate*100))
+	}
+	return c
+}
+
+// errorRate returns the share of the requests that failed.
+func errorRate(rep *Report) float64 {
+	var errs int
+	for _, n := range rep.Errors {
+		errs += n
+	}
+	if errs == 0 {
+		return 0
+	}
+	return float64(errs) / float64(errs+rep.Requests)
+}
+
+// Print writes the comparison as a table followed by the regressions.
+func (c *Comparison) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\tBaseline\tCurrent\tDelta\tChange\t\n")
+	for _, row := range c.Rows {
+		abs, rel := row.Delta()
+		change := "-"
+		if !math.IsNaN(rel) {
+			change = fmt.Sprintf("%+.1f%%", rel*100)
+		}
+		switch row.Unit {
+		case "secs":
+			fmt.Fprintf(tw, "%s\t%4.4f secs\t%4.4f secs\t%+4.4f\t%s\t\n", row.Metric, row.Baseline, row.Current, abs, change)
+		case "%":
+			fmt.Fprintf(tw, "%s\t%.2f%%\t%.2f%%\t%+.2f\t%s\t\n", row.Metric, row.Baseline*100, row.Current*100, abs*100, change)
+		default:
+			fmt.Fprintf(tw, "%s\t%4.4f\t%4.4f\t%+4.4f\t%s\t\n", row.Metric, row.Baseline, row.Current, abs, change)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	direction := "faster"
+	if c.Slower {
+		direction = "slower"
+	}
+	fmt.Fprintf(w, "\nMann-Whitney U test: p = %.4g (current tends to be %s)\n", c.P, direction)
+	if len(c.Regressions) == 0 {
+		_, err := fmt.Fprintf(w, "No regression.\n")
+		return err
+	}
+	fmt.Fprintf(w, "\nRegressions:\n")
+	for _, msg := range c.Regressions {
+		fmt.Fprintf(w, "  %s\n", msg)
+	}
+	return nil
+}
+
+// mannWhitney runs the two-sided Mann-Whitney U test on samples a and b,
+// using the normal approximation with a correction for ties. It returns
+// the p-value and the z-score, which is positive if values in a tend to be
+// larger than values in b. The p-value is 1 if either sample is empty.
+func mannWhitney(a, b []float64) (p, z float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1, 0
+	}
+	type value struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, value{v, true})
+	}
+	for _, v := range b {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Tied values share the average of their ranks.
+	var rankSum, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1, 0
+	}
+	z = (u - mean) / math.Sqrt(variance)
+	return math.Erfc(math.Abs(z) / math.Sqrt2), z
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JarCookie is a cookie the cookie jars of the workers start with.
+type JarCookie struct {
+	// URL is where the cookie is from. Unless the cookie has a Domain, it
+	// is only sent to the host of URL.
+	URL    string
+	Cookie *http.Cookie
+}
+
+// LoadCookies reads cookies in the Netscape cookie file format written by
+// curl and browser extensions: one cookie per line with the tab-separated
+// fields domain, include subdomains, path, secure, expiry, name and value.
+func LoadCookies(rd io.Reader) ([]JarCookie, error) {
+	var cookies []JarCookie
+	sc := bufio.NewScanner(rd)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 7 {
+			return nil, fmt.Errorf("cookie file line %d: expected 7 tab-separated fields, found %d", n, len(f))
+		}
+		expiry, err := strconv.ParseInt(f[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cookie file line %d: invalid expiry %q", n, f[4])
+		}
+		c := &http.Cookie{
+			Name:     f[5],
+			Value:    f[6],
+			Path:     f[2],
+			Secure:   strings.EqualFold(f[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		host := strings.TrimPrefix(f[0], ".")
+		if strings.EqualFold(f[1], "TRUE") {
+			c.Domain = host
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		u := url.URL{Scheme: scheme, Host: host, Path: c.Path}
+		cookies = append(cookies, JarCookie{URL: u.String(), Cookie: c})
+	}
+	return cookies, sc.Err()
+}
+
+// usesJar reports whether the workers keep cookies.
+func (b *Work) usesJar() bool {
+	return b.CookieJar || len(b.Cookies) > 0
+}
+
+// newJar returns a cookie jar holding the Work's Cookies.
+func (b *Work) newJar() http.CookieJar {
+	jar, _ := cookiejar.New(nil)
+	for _, c := range b.Cookies {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			Warning.Printf("cookie %s: %v\n", c.Cookie.Name, err)
+			continue
+		}
+		jar.SetCookies(u, []*http.Cookie{c.Cookie})
+	}
+	return jar
+}
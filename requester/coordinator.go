@@ -0,0 +1,326 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator spreads a load test over several agents and prints a single
+// report merged from theirs.
+type Coordinator struct {
+	// Agents are the host:port addresses of the agents.
+	Agents []string
+
+	// Work is the test to run. N, C and QPS are split across the agents,
+	// and so are the input rows with Once. It is sent to the agents in
+	// plain text, so it cannot have OAuth2 credentials or a Signer.
+	Work *Work
+
+	// StartDelay is how long after preparing the agents they all start.
+	// It must cover the time to reach every agent. Default is 1s.
+	StartDelay time.Duration
+
+	// Token is sent to the agents as a bearer token. It must match
+	// their Agent.Token.
+	Token string
+}
+
+// agentStatus is the outcome of the test on one agent.
+type agentStatus struct {
+	addr     string
+	requests int
+	err      error
+}
+
+// Run prepares the test on all agents, starts them at the same time and
+// returns the merged report, rendered by the Work's Renderer if one is set.
+// It fails if any agent cannot be prepared or started, after resetting the
+// agents already reached so that they can take another test; agents failing while
+// the test runs are listed in the report and left out of the merge. Once
+// ctx is cancelled the agents are stopped and the report covers the
+// requests they completed.
+func (c *Coordinator) Run(ctx context.Context) (*Report, error) {
+	if len(c.Agents) == 0 {
+		return nil, fmt.Errorf("no agents")
+	}
+	if c.Work.OAuth2 != nil || c.Work.Signer != nil {
+		return nil, fmt.Errorf("OAuth2 and Signer cannot be used with agents")
+	}
+	for i, addr := range c.Agents {
+		if err := c.post(ctx, addr, "/prepare", c.plan(i)); err != nil {
+			c.signal(c.Agents[:i], "/reset")
+			return nil, fmt.Errorf("agent %s: %v", addr, err)
+		}
+	}
+	delay := c.StartDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	start := startSpec{StartAt: time.Now().Add(delay)}
+	for _, addr := range c.Agents {
+		if err := c.post(ctx, addr, "/start", start); err != nil {
+			c.signal(c.Agents, "/reset")
+			return nil, fmt.Errorf("agent %s: %v", addr, err)
+		}
+	}
+
+	// The results outlive ctx for as long as the stopped agents take to
+	// finish their in-flight requests.
+	resCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		c.signal(c.Agents, "/stop")
+		time.AfterFunc(c.Work.GracePeriod+agentTimeout, cancel)
+	})
+	defer stop()
+
+	statuses := make([]agentStatus, len(c.Agents))
+	snaps := make([]*snapshot, len(c.Agents))
+	var wg sync.WaitGroup
+	for i, addr := range c.Agents {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			statuses[i].addr = addr
+			snaps[i], statuses[i].err = c.fetchResult(resCtx, addr)
+			if snaps[i] != nil {
+				statuses[i].requests = len(snaps[i].Lats)
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	r := newReport(nil, nil)
+	r.agents = statuses
+	r.work = c.Work
+	r.interrupted = ctx.Err() != nil
+	var merged int
+	for _, snap := range snaps {
+		if snap != nil {
+			r.merge(snap)
+			merged++
+		}
+	}
+	r.calculate()
+	rep := r.summary()
+	if c.Work.Renderer != nil {
+		if err := c.Work.Renderer.Render(rep); err != nil {
+			return rep, err
+		}
+	}
+	if merged == 0 {
+		return rep, fmt.Errorf("all agents failed")
+	}
+	return rep, nil
+}
+
+// agentTimeout bounds the calls to stop or reset the agents and the wait
+// for their results after stopping them.
+const agentTimeout = 5 * time.Second
+
+// signal posts path, /stop or /reset, to the given agents.
+func (c *Coordinator) signal(agents []string, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, addr := range agents {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := c.post(ctx, addr, path, struct{}{}); err != nil {
+				Warning.Printf("agent %s: %s: %v\n", addr, path, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// plan returns the share of the test run by the i-th agent.
+func (c *Coordinator) plan(i int) *plan {
+	p := &plan{Work: *c.Work}
+	p.Request = requestSpec{
+		Method: c.Work.Request.Method,
+		URL:    c.Work.Request.URL.String(),
+		Header: c.Work.Request.Header,
+		Host:   c.Work.Request.Host,
+	}
+	n := len(c.Agents)
+	p.N = share(c.Work.N, n, i)
+	p.C = share(c.Work.C, n, i)
+	if p.C < 1 {
+		p.C = 1
+	}
+	p.QPS = c.Work.QPS / float64(n)
+	p.Burst = share(c.Work.Burst, n, i)
+	if c.Work.Once {
+		// Every agent sends its own part of the input.
+		rows := c.Work.RequestParamSlice.RequestParams
+		var lo int
+		for j := 0; j < i; j++ {
+			lo += share(len(rows), n, j)
+		}
+		p.RequestParamSlice = &RequestParamSlice{
+			RequestParams: rows[lo : lo+share(len(rows), n, i)],
+		}
+	}
+	return p
+}
+
+// share splits total into n parts and returns the i-th, handing out the
+// remainder to the first parts.
+func share(total, n, i int) int {
+	s := total / n
+	if i < total%n {
+		s++
+	}
+	return s
+}
+
+// merge adds the results of an agent to the report.
+func (r *report) merge(s *snapshot) {
+	if s.TimeUsed > r.timeUsed {
+		r.timeUsed = s.TimeUsed
+	}
+	if r.startTime.IsZero() || s.StartTime.Before(r.startTime) {
+		r.startTime = s.StartTime
+	}
+	r.lats = append(r.lats, s.Lats...)
+	r.starts = append(r.starts, s.Starts...)
+	r.codes = append(r.codes, s.Codes...)
+	r.errStarts = append(r.errStarts, s.ErrStarts...)
+	r.connLats = append(r.connLats, s.ConnLats...)
+	r.dnsLats = append(r.dnsLats, s.DNSLats...)
+	r.tlsLats = append(r.tlsLats, s.TLSLats...)
+	r.reqLats = append(r.reqLats, s.ReqLats...)
+	r.delayLats = append(r.delayLats, s.DelayLats...)
+	r.resLats = append(r.resLats, s.ResLats...)
+	r.avgTotal += sum(s.Lats)
+	r.avgConn += sum(s.ConnLats)
+	r.avgDNS += sum(s.DNSLats)
+	r.avgTLS += sum(s.TLSLats)
+	r.avgReq += sum(s.ReqLats)
+	r.avgDelay += sum(s.DelayLats)
+	r.avgRes += sum(s.ResLats)
+	for code, num := range s.StatusCodeDist {
+		r.statusCodeDist[code] += num
+	}
+	for err, num := range s.ErrorDist {
+		r.errorDist[err] += num
+	}
+	r.sizeTotal += s.SizeTotal
+	r.grpc = r.grpc || s.GRPC
+	if s.Retries != nil {
+		if r.retries == nil {
+			r.retries = &RetryStats{}
+		}
+		r.retries.merge(s.Retries)
+	}
+	if s.Hedges != nil {
+		if r.hedges == nil {
+			r.hedges = &HedgeStats{}
+		}
+		r.hedges.merge(s.Hedges)
+	}
+	if s.Think != nil {
+		if r.think == nil {
+			r.think = &ThinkStats{}
+		}
+		r.think.merge(s.Think)
+	}
+	r.mergeGroups(s.Groups)
+	if s.Token != nil {
+		if r.token == nil {
+			r.token = &TokenStats{}
+		}
+		r.token.merge(s.Token)
+	}
+}
+
+func sum(vals []float64) float64 {
+	var total float64
+	for _, v := range vals {
+		total += v
+	}
+	return total
+}
+
+func agentURL(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return addr + path
+}
+
+func (c *Coordinator) post(ctx context.Context, addr, path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", agentURL(addr, path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// fetchResult waits for the agent to finish and returns its report.
+func (c *Coordinator) fetchResult(ctx context.Context, addr string) (*snapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", agentURL(addr, "/result"), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var snap snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// authorize adds the Token to a call to an agent.
+func (c *Coordinator) authorize(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+}
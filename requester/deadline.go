@@ -0,0 +1,225 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hedgeWindow is the number of recent response times the hedging
+	// delay is estimated from.
+	hedgeWindow = 1000
+
+	// hedgeMinSamples is the number of responses needed before requests
+	// are hedged with an estimated delay.
+	hedgeMinSamples = 20
+)
+
+// TimeoutError is the error of a request cut off by one of the Work's phase
+// timeouts. Its message names the phase, so that each kind of timeout has
+// its own line in the error distribution.
+type TimeoutError struct {
+	Phase string // "dial", "TLS handshake", "first byte" or "body"
+}
+
+func (e *TimeoutError) Error() string { return e.Phase + " timeout" }
+
+// Timeout marks the error as a timeout, as net.Error does.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary is part of net.Error.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// phaseTimer cancels a request once the phase it is in takes too long. It
+// is re-armed on every phase change reported by the http-trace hooks.
+type phaseTimer struct {
+	mu     sync.Mutex
+	t      *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+// arm limits the current phase to d, or lifts the limit if d is zero.
+func (pt *phaseTimer) arm(d time.Duration, phase string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.t != nil {
+		pt.t.Stop()
+		pt.t = nil
+	}
+	if d > 0 {
+		pt.t = time.AfterFunc(d, func() { pt.cancel(&TimeoutError{Phase: phase}) })
+	}
+}
+
+func (pt *phaseTimer) stop() {
+	pt.arm(0, "")
+}
+
+// hasPhaseTimeouts reports whether any of the phase timeouts is set.
+func (b *Work) hasPhaseTimeouts() bool {
+	return b.DialTimeout > 0 || b.TLSTimeout > 0 || b.FirstByteTimeout > 0 || b.BodyTimeout > 0
+}
+
+// latencyWindow estimates the 95th percentile of the most recent response
+// times.
+type latencyWindow struct {
+	mu    sync.Mutex
+	lats  []time.Duration
+	next  int
+	added int
+	p95   time.Duration
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.lats) < hedgeWindow {
+		w.lats = append(w.lats, d)
+	} else {
+		w.lats[w.next] = d
+		w.next = (w.next + 1) % hedgeWindow
+	}
+	w.added++
+	// Sorting the window on every response would cost more than the
+	// estimate is worth; refresh it every few responses instead.
+	if w.added >= hedgeMinSamples && (w.p95 == 0 || w.added%50 == 0) {
+		sorted := append([]time.Duration(nil), w.lats...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		w.p95 = sorted[len(sorted)*95/100]
+	}
+}
+
+// delay returns the current estimate, or false until there is one.
+func (w *latencyWindow) delay() (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.p95, w.p95 > 0
+}
+
+// hedgeDelay returns how long a request may take before it is hedged.
+func (b *Work) hedgeDelay() (time.Duration, bool) {
+	if b.HedgeDelay > 0 {
+		return b.HedgeDelay, true
+	}
+	return b.hedgeLats.delay()
+}
+
+// HedgeStats tells how often hedging sent a duplicate request and how often
+// the duplicate won.
+type HedgeStats struct {
+	// Requests is the number of requests, hedged or not.
+	Requests int
+
+	// Hedged is the number of requests a duplicate was sent for.
+	Hedged int
+
+	// Won is the number of hedged requests the duplicate completed first.
+	Won int
+}
+
+func (s *HedgeStats) add(res *Result) {
+	s.Requests++
+	if res.Hedged {
+		s.Hedged++
+	}
+	if res.HedgeWon {
+		s.Won++
+	}
+}
+
+func (s *HedgeStats) merge(o *HedgeStats) {
+	s.Requests += o.Requests
+	s.Hedged += o.Hedged
+	s.Won += o.Won
+}
+
+// errHedgeLost cancels the attempt that lost a hedged request.
+var errHedgeLost = errors.New("hedged request lost")
+
+// hedgedAttempt sends the request for input row p and, if it takes longer
+// than the hedging delay, a duplicate. The first to complete wins and the
+// other is cancelled. The result spans from the start of the first.
+func (b *Work) hedgedAttempt(c *http.Client, p *RequestParam) (*Result, time.Duration) {
+	type outcome struct {
+		res   *Result
+		after time.Duration
+		hedge bool
+	}
+	s := time.Now()
+	ctx, cancel := context.WithCancelCause(b.context())
+	defer cancel(nil)
+	outcomes := make(chan outcome, 2)
+	start := func(hedge bool) {
+		res, after := b.attempt(ctx, c, p)
+		outcomes <- outcome{res, after, hedge}
+	}
+	go start(false)
+	pending := 1
+
+	var timer <-chan time.Time
+	if d, ok := b.hedgeDelay(); ok {
+		timer = time.After(d)
+	}
+	hedged := false
+	var won outcome
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			hedged = true
+			go start(true)
+			pending++
+			continue
+		case won = <-outcomes:
+		}
+		pending--
+		// A failed attempt only wins if the other one fails too.
+		if won.res.Err == nil || pending == 0 {
+			break
+		}
+	}
+	cancel(errHedgeLost)
+	for ; pending > 0; pending-- {
+		<-outcomes
+	}
+
+	res := won.res
+	res.Hedged = hedged
+	res.HedgeWon = won.hedge
+	res.Duration = res.Start.Add(res.Duration).Sub(s)
+	res.Start = s
+	if res.Err == nil && b.HedgeDelay == 0 {
+		b.hedgeLats.add(res.Duration)
+	}
+	return res, won.after
+}
+
+// printHedges prints how often hedging sent a duplicate and how often it
+// won.
+func (r *report) printHedges() {
+	s := r.hedges
+	r.printf("\nHedging:\n")
+	r.printf("  Hedged:\t%d of %d requests\n", s.Hedged, s.Requests)
+	r.printf("  Duplicate won:\t%d of %d hedged requests\n", s.Won, s.Hedged)
+	if s.Requests > 0 {
+		r.printf("  Extra load:\t%.2f%%\n", float64(s.Hedged)/float64(s.Requests)*100)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// RequestGroup is one kind of request in a mix, such as the searches of a
+// workload that is 70% searches. The Work's Request supplies the headers
+// and whatever the group leaves empty.
+type RequestGroup struct {
+	// Name labels the group in the report and, unless the Work has a
+	// TagField, tags its results.
+	Name string
+
+	// Weight is the group's share of the requests, relative to the
+	// weights of the other groups.
+	Weight int
+
+	Method string
+	URL    string
+
+	// RequestParamSlice holds the group's input rows and DataType says
+	// how they are sent, as for the Work.
+	RequestParamSlice *RequestParamSlice
+	DataType          string
+
+	request *http.Request
+	seq     int64 // sequence number of the group's next input row
+}
+
+// rows returns the input rows of g, falling back to those of the Work.
+func (g *RequestGroup) rows(b *Work) []RequestParam {
+	if g.RequestParamSlice != nil {
+		return g.RequestParamSlice.RequestParams
+	}
+	if b.RequestParamSlice != nil {
+		return b.RequestParamSlice.RequestParams
+	}
+	return nil
+}
+
+// prepareGroups checks the Groups, builds the request template of each and
+// the order the groups take turns in.
+func (b *Work) prepareGroups() error {
+	if len(b.Groups) == 0 {
+		return nil
+	}
+	if b.GRPC || b.isWebSocket() {
+		return errors.New("request groups only apply to HTTP requests")
+	}
+	if b.Once {
+		return errors.New("request groups cannot be used with Once")
+	}
+	names := make(map[string]bool)
+	weights := make([]int, len(b.Groups))
+	for i, g := range b.Groups {
+		if g.Name == "" || names[g.Name] {
+			return fmt.Errorf("request group %d needs a unique name", i+1)
+		}
+		names[g.Name] = true
+		if g.Weight <= 0 {
+			return fmt.Errorf("request group %s needs a positive weight", g.Name)
+		}
+		weights[i] = g.Weight
+		req := b.Request.Clone(b.Request.Context())
+		if g.Method != "" {
+			req.Method = g.Method
+		}
+		if g.URL != "" {
+			u, err := url.Parse(g.URL)
+			if err != nil {
+				return fmt.Errorf("request group %s: %v", g.Name, err)
+			}
+			req.URL, req.Host = u, u.Host
+		}
+		g.request = req
+		g.seq = 0
+	}
+	b.groupOrder = weightedOrder(weights)
+	return nil
+}
+
+// weightedOrder returns a cycle of indexes into weights in which every
+// index appears as often as its weight says, spread as evenly as smooth
+// weighted round-robin spreads them.
+func weightedOrder(weights []int) []int {
+	g := weights[0]
+	for _, w := range weights[1:] {
+		g = gcd(g, w)
+	}
+	total := 0
+	for _, w := range weights {
+		total += w / g
+	}
+	order := make([]int, 0, total)
+	current := make([]int, len(weights))
+	for len(order) < total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w / g
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		order = append(order, best)
+	}
+	return order
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// groupRequestParam returns the request with sequence number idx: the
+// group whose turn it is and its next input row.
+func (b *Work) groupRequestParam(idx int) RequestParam {
+	g := b.Groups[b.groupOrder[idx%len(b.groupOrder)]]
+	p := RequestParam{Content: []byte(""), group: g}
+	rows := g.rows(b)
+	if len(rows) == 0 {
+		return p
+	}
+	if b.RandomInput {
+		p.Content = rows[rand.Intn(len(rows))].Content
+	} else {
+		p.Content = rows[(atomic.AddInt64(&g.seq, 1)-1)%int64(len(rows))].Content
+	}
+	return p
+}
+
+// template returns the request template and data type of input row p.
+func (b *Work) template(p *RequestParam) (*http.Request, string) {
+	if g := p.group; g != nil {
+		if g.DataType != "" {
+			return g.request, g.DataType
+		}
+		return g.request, b.DataType
+	}
+	return b.Request, b.DataType
+}
+
+// groupStats is the part of the report about one request group. Its fields
+// are exported to ship it from agents.
+type groupStats struct {
+	Lats           []float64
+	StatusCodeDist map[int]int
+	ErrorDist      map[string]int
+}
+
+func (r *report) group(name string) *groupStats {
+	if r.groups == nil {
+		r.groups = make(map[string]*groupStats)
+	}
+	g := r.groups[name]
+	if g == nil {
+		g = &groupStats{StatusCodeDist: make(map[int]int), ErrorDist: make(map[string]int)}
+		r.groups[name] = g
+	}
+	return g
+}
+
+func (r *report) addGroup(res *Result) {
+	g := r.group(res.Group)
+	if res.Err != nil {
+		g.ErrorDist[res.Err.Error()]++
+		return
+	}
+	g.Lats = append(g.Lats, res.Duration.Seconds())
+	g.StatusCodeDist[res.StatusCode]++
+}
+
+func (r *report) mergeGroups(groups map[string]*groupStats) {
+	for name, s := range groups {
+		g := r.group(name)
+		g.Lats = append(g.Lats, s.Lats...)
+		for code, num := range s.StatusCodeDist {
+			g.StatusCodeDist[code] += num
+		}
+		for err, num := range s.ErrorDist {
+			g.ErrorDist[err] += num
+		}
+	}
+}
+
+// GroupReport summarizes the requests of one RequestGroup.
+type GroupReport struct {
+	Name string
+
+	// Requests is the number of responses received and Failed the number
+	// of requests that failed.
+	Requests int
+	Failed   int
+
+	Fastest time.Duration
+	Slowest time.Duration
+	Average time.Duration
+
+	// Latencies holds the response times at the 50th, 90th, 95th and 99th
+	// percentiles.
+	Latencies []Percentile
+
+	StatusCodes map[int]int
+	Errors      map[string]int
+}
+
+// groupNames returns the names of the groups in the report, in the order
+// of the Work's Groups if known.
+func (r *report) groupNames() []string {
+	var names []string
+	if r.work != nil {
+		for _, g := range r.work.Groups {
+			if r.groups[g.Name] != nil {
+				names = append(names, g.Name)
+			}
+		}
+	}
+	if len(names) == len(r.groups) {
+		return names
+	}
+	names = names[:0]
+	for name := range r.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupReports returns the summaries of the request groups.
+func (r *report) groupReports() []GroupReport {
+	var reps []GroupReport
+	for _, name := range r.groupNames() {
+		g := r.groups[name]
+		rep := GroupReport{
+			Name:        name,
+			Requests:    len(g.Lats),
+			StatusCodes: g.StatusCodeDist,
+			Errors:      g.ErrorDist,
+		}
+		for _, num := range g.ErrorDist {
+			rep.Failed += num
+		}
+		if len(g.Lats) > 0 {
+			sorted := append([]float64(nil), g.Lats...)
+			sort.Float64s(sorted)
+			rep.Fastest = seconds(sorted[0])
+			rep.Slowest = seconds(sorted[len(sorted)-1])
+			rep.Average = seconds(sum(sorted) / float64(len(sorted)))
+			pctls := []int{50, 90, 95, 99}
+			for i, lat := range percentiles(sorted, pctls) {
+				rep.Latencies = append(rep.Latencies, Percentile{P: pctls[i], Latency: seconds(lat)})
+			}
+		}
+		reps = append(reps, rep)
+	}
+	return reps
+}
+
+// printGroups prints the summary of every request group.
+func (r *report) printGroups() {
+	r.printf("\nRequest groups:\n")
+	total := 0
+	reps := r.groupReports()
+	for _, g := range reps {
+		total += g.Requests + g.Failed
+	}
+	for _, g := range reps {
+		r.printf("  %s:\t%d responses, %d errors (%.1f%% of all requests)\n", g.Name, g.Requests, g.Failed,
+			float64(g.Requests+g.Failed)/float64(total)*100)
+		if g.Requests > 0 {
+			r.printf("    Average:\t%4.4f secs\n", g.Average.Seconds())
+			for _, p := range g.Latencies {
+				r.printf("    %d%%:\t%4.4f secs\n", p.P, p.Latency.Seconds())
+			}
+		}
+		for code, num := range g.StatusCodes {
+			r.printf("    [%d]\t%d responses\n", code, num)
+		}
+		for err, num := range g.Errors {
+			r.printf("    [%d]\t%s\n", num, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// splitGRPCCall splits "pkg.Service/Method" or "pkg.Service.Method" into
+// the service and method names.
+func splitGRPCCall(call string) (string, string, error) {
+	call = strings.TrimPrefix(call, "/")
+	i := strings.LastIndex(call, "/")
+	if i < 0 {
+		i = strings.LastIndex(call, ".")
+	}
+	if i <= 0 || i == len(call)-1 {
+		return "", "", fmt.Errorf("invalid gRPC call %q, expected pkg.Service/Method", call)
+	}
+	return call[:i], call[i+1:], nil
+}
+
+// grpcDial creates a client connection to the host of the request
+// template. An https url selects TLS, anything else plaintext.
+func (b *Work) grpcDial() (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if b.Request.URL.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: true,
+		})
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(grpcResponses{}),
+	}
+	if b.Request.Host != "" {
+		opts = append(opts, grpc.WithAuthority(b.Request.Host))
+	}
+	return grpc.NewClient(b.Request.URL.Host, opts...)
+}
+
+// resolveGRPCMethod finds the descriptor of GRPCCall, either in the
+// GRPCProto source file or through the server reflection service.
+func (b *Work) resolveGRPCMethod() (protoreflect.MethodDescriptor, error) {
+	service, method, err := splitGRPCCall(b.GRPCCall)
+	if err != nil {
+		return nil, err
+	}
+
+	var sd *desc.ServiceDescriptor
+	if b.GRPCProto != "" {
+		parser := protoparse.Parser{
+			ImportPaths: []string{filepath.Dir(b.GRPCProto)},
+		}
+		fds, err := parser.ParseFiles(filepath.Base(b.GRPCProto))
+		if err != nil {
+			return nil, err
+		}
+		sd = fds[0].FindService(service)
+		if sd == nil {
+			return nil, fmt.Errorf("service %s not found in %s", service, b.GRPCProto)
+		}
+	} else {
+		conn, err := b.grpcDial()
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(b.context(), 10*time.Second)
+		defer cancel()
+		client := grpcreflect.NewClientAuto(ctx, conn)
+		defer client.Reset()
+		sd, err = client.ResolveService(service)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md := sd.FindMethodByName(method)
+	if md == nil {
+		return nil, fmt.Errorf("method %s not found in service %s", method, service)
+	}
+	if md.IsClientStreaming() || md.IsServerStreaming() {
+		return nil, fmt.Errorf("method %s is streaming, only unary calls are supported", b.GRPCCall)
+	}
+	return md.UnwrapMethod(), nil
+}
+
+// grpcMetadata turns the request template headers into call metadata.
+func (b *Work) grpcMetadata() metadata.MD {
+	md := metadata.MD{}
+	for k, s := range b.Request.Header {
+		// gRPC sets its own content type.
+		if strings.EqualFold(k, "Content-Type") {
+			continue
+		}
+		md.Append(k, s...)
+	}
+	return md
+}
+
+// runGRPCWorker makes unary calls of the resolved method on a worker's
+// own client connection. If the connection cannot be set up, every call
+// the worker takes fails.
+func (b *Work) runGRPCWorker() {
+	conn, err := b.grpcDial()
+	if err != nil {
+		Error.Println(err)
+	} else {
+		defer conn.Close()
+	}
+
+	md := b.grpcMetadata()
+	b.runLoop(func(i int) {
+		p := b.getRequestParam(i)
+		if err != nil {
+			b.sendResult(&p, &Result{Start: time.Now(), Err: err})
+			return
+		}
+		b.grpcInvoke(conn, md, &p)
+	})
+}
+
+// respondedKey is the context key of the flag grpcResponses sets once the
+// server answers a call.
+type respondedKey struct{}
+
+// grpcResponses tells the calls the server answered, with headers or a
+// status, from those that failed before, such as on a broken connection.
+type grpcResponses struct{}
+
+func (grpcResponses) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (grpcResponses) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	switch s.(type) {
+	case *stats.InHeader, *stats.InTrailer:
+		if responded, ok := ctx.Value(respondedKey{}).(*atomic.Bool); ok {
+			responded.Store(true)
+		}
+	}
+}
+
+func (grpcResponses) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (grpcResponses) HandleConn(context.Context, stats.ConnStats) {}
+
+// grpcInvoke converts the JSON input row to the request message and makes
+// one call. Every call the server answered is reported with its gRPC status
+// code. A call that failed before, like an HTTP request getting no
+// response, and an input row that is no valid request message are reported
+// as failed requests.
+func (b *Work) grpcInvoke(conn *grpc.ClientConn, md metadata.MD, p *RequestParam) {
+	defer b.Metrics.request(b.TestName)()
+	in := dynamicpb.NewMessage(b.grpcMethod.Input())
+	if content := bytes.TrimSpace(p.Content); len(content) > 0 {
+		if err := protojson.Unmarshal(content, in); err != nil {
+			Error.Println(err)
+			b.sendResult(p, &Result{Start: time.Now(), Err: fmt.Errorf("invalid request message: %v", err)})
+			return
+		}
+	}
+	out := dynamicpb.NewMessage(b.grpcMethod.Output())
+
+	var responded atomic.Bool
+	ctx := metadata.NewOutgoingContext(b.context(), md)
+	ctx = context.WithValue(ctx, respondedKey{}, &responded)
+	if b.SingleRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.SingleRequestTimeout)
+		defer cancel()
+	}
+
+	s := time.Now()
+	err := conn.Invoke(ctx, b.grpcFullMethod, in, out)
+	finish := time.Now().Sub(s)
+
+	if err != nil && !responded.Load() {
+		Error.Println(err)
+		if b.Capture.want(false, err) {
+			b.Capture.add(&CapturedResponse{
+				Time:          s,
+				Input:         string(p.Content),
+				URL:           b.grpcFullMethod,
+				RequestHeader: http.Header(md),
+				Error:         err.Error(),
+				Duration:      finish.Seconds(),
+			})
+		}
+		b.sendResult(p, &Result{Start: s, Duration: finish, Err: err})
+		return
+	}
+
+	code := status.Code(err)
+	var size int64
+	if err == nil {
+		size = int64(proto.Size(out))
+	}
+	capture := b.Capture.want(code == codes.OK, err)
+	if capture || b.printResponses() {
+		var reply []byte
+		if err == nil {
+			reply, _ = protojson.Marshal(out)
+		} else {
+			reply = []byte(status.Convert(err).Message())
+		}
+		if capture {
+			c := &CapturedResponse{
+				Time:          s,
+				Input:         string(p.Content),
+				URL:           b.grpcFullMethod,
+				RequestHeader: http.Header(md),
+				Status:        int(code),
+				Duration:      finish.Seconds(),
+				Body:          string(reply),
+			}
+			if err != nil {
+				c.Error = err.Error()
+			}
+			b.Capture.add(c)
+		} else {
+			Info.Printf("%s\t%s\t%s\n", bytes.TrimSpace(p.Content), code, reply)
+		}
+	}
+
+	b.sendResult(p, &Result{
+		Start:         s,
+		StatusCode:    int(code),
+		Duration:      finish,
+		ContentLength: size,
+	})
+}
+
+func grpcCodeName(code int) string {
+	return codes.Code(code).String()
+}
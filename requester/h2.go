@@ -0,0 +1,160 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// h2Conn is a single multiplexed HTTP/2 connection shared by several
+// workers. Every h2Conn owns its own transport, so the transport's pool
+// never holds more than one live connection at a time.
+type h2Conn struct {
+	idx     int
+	tr      *http2.Transport
+	streams chan struct{} // limits concurrent streams, nil if unlimited
+
+	requests   int64 // streams opened on this connection
+	active     int64 // streams currently in flight
+	maxActive  int64 // highest number of concurrent streams seen
+	dials      int64 // connections dialed, more than one means reconnects
+	goAways    int64 // requests failed by a GOAWAY from the server
+	rstStreams int64 // requests failed by a RST_STREAM from the server
+}
+
+// newH2Conns creates the connections used by the HTTP/2 multiplexing mode.
+func (b *Work) newH2Conns() []*h2Conn {
+	conns := make([]*h2Conn, b.H2Conns)
+	for i := range conns {
+		c := &h2Conn{idx: i}
+		if b.H2StreamsPerConn > 0 {
+			c.streams = make(chan struct{}, b.H2StreamsPerConn)
+		}
+		c.tr = &http2.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DisableCompression: b.DisableCompression,
+			// Queue streams on the existing connection instead of
+			// opening another one once the server's limit is reached.
+			StrictMaxConcurrentStreams: true,
+		}
+		if b.H2C {
+			// h2c with prior knowledge: speak HTTP/2 over plain TCP.
+			c.tr.AllowHTTP = true
+			c.tr.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				atomic.AddInt64(&c.dials, 1)
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		} else {
+			c.tr.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				atomic.AddInt64(&c.dials, 1)
+				d := tls.Dialer{Config: cfg}
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		conns[i] = c
+	}
+	return conns
+}
+
+// closeH2Conns closes the connections once all workers are done.
+func (b *Work) closeH2Conns() {
+	for _, c := range b.h2Conns {
+		c.tr.CloseIdleConnections()
+	}
+}
+
+// RoundTrip sends req as a new stream on the connection. The stream slot
+// is held until the response body is closed.
+func (c *h2Conn) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.streams != nil {
+		select {
+		case c.streams <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	atomic.AddInt64(&c.requests, 1)
+	active := atomic.AddInt64(&c.active, 1)
+	for {
+		max := atomic.LoadInt64(&c.maxActive)
+		if active <= max || atomic.CompareAndSwapInt64(&c.maxActive, max, active) {
+			break
+		}
+	}
+
+	resp, err := c.tr.RoundTrip(req)
+	if err != nil {
+		c.countError(err)
+		c.release()
+		return nil, err
+	}
+	resp.Body = &h2Body{ReadCloser: resp.Body, conn: c}
+	return resp, nil
+}
+
+func (c *h2Conn) release() {
+	atomic.AddInt64(&c.active, -1)
+	if c.streams != nil {
+		<-c.streams
+	}
+}
+
+// countError records GOAWAY and RST_STREAM failures sent by the server.
+func (c *h2Conn) countError(err error) {
+	var goAway http2.GoAwayError
+	var rst http2.StreamError
+	switch {
+	case errors.As(err, &goAway):
+		atomic.AddInt64(&c.goAways, 1)
+	case errors.As(err, &rst):
+		atomic.AddInt64(&c.rstStreams, 1)
+	}
+}
+
+// h2Body ends the stream on Close and watches reads for stream resets.
+type h2Body struct {
+	io.ReadCloser
+	conn   *h2Conn
+	failed bool
+	closed int32
+}
+
+func (b *h2Body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !b.failed {
+		b.failed = true
+		b.conn.countError(err)
+	}
+	return n, err
+}
+
+func (b *h2Body) Close() error {
+	err := b.ReadCloser.Close()
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.conn.release()
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3Transport makes HTTP/3 requests over QUIC for a single worker.
+type h3Transport struct {
+	tr                *http3.Transport
+	zeroRTT           bool
+	disableKeepAlives bool
+}
+
+// newH3Transport creates the QUIC round tripper used in place of the
+// HTTP/1.1 and HTTP/2 transports when H3 is set.
+func (b *Work) newH3Transport() *h3Transport {
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if b.H3ZeroRTT {
+		// 0-RTT needs a session ticket from an earlier connection, so the
+		// cache is shared by all workers.
+		cfg.ClientSessionCache = b.h3Sessions
+	}
+	return &h3Transport{
+		tr: &http3.Transport{
+			TLSClientConfig:    cfg,
+			QUICConfig:         &quic.Config{},
+			DisableCompression: b.DisableCompression,
+		},
+		zeroRTT:           b.H3ZeroRTT,
+		disableKeepAlives: b.DisableKeepAlives,
+	}
+}
+
+// RoundTrip sends req over HTTP/3. With 0-RTT enabled, idempotent GET and
+// HEAD requests are sent in early data when the session can be resumed.
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.disableKeepAlives {
+		// QUIC has no keep-alive to turn off; drop the connections left
+		// idle by earlier requests so that this one dials a new one.
+		t.tr.CloseIdleConnections()
+	}
+	if t.zeroRTT {
+		switch req.Method {
+		case http.MethodGet:
+			req = cloneMethod(req, http3.MethodGet0RTT)
+		case http.MethodHead:
+			req = cloneMethod(req, http3.MethodHead0RTT)
+		}
+	}
+	return t.tr.RoundTrip(req)
+}
+
+// Close closes the QUIC connections and the UDP socket of the transport.
+func (t *h3Transport) Close() error {
+	return t.tr.Close()
+}
+
+func cloneMethod(r *http.Request, method string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Method = method
+	return r2
+}
@@ -0,0 +1,352 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTMLRenderer writes the report as a single HTML page with charts. The
+// page embeds everything it needs, so it can be opened offline and shared
+// as one file.
+type HTMLRenderer struct {
+	W io.Writer
+}
+
+type htmlRow struct {
+	Name  string
+	Value string
+}
+
+type htmlPage struct {
+	Generated   string
+	Interrupted bool
+	Summary     []htmlRow
+	Latencies   []htmlRow
+	Phases      []Phase
+	Codes       []htmlRow
+	Errors      []htmlRow
+	Config      []htmlRow
+	Agents      []htmlRow
+
+	Histogram    template.HTML
+	LatencyChart template.HTML
+	RPSChart     template.HTML
+}
+
+func (h *HTMLRenderer) Render(rep *Report) error {
+	r := rep.r
+	page := htmlPage{
+		Generated:   time.Now().Format(time.RFC1123),
+		Interrupted: rep.Interrupted,
+		Phases:      rep.Phases,
+		Config:      workConfig(r.work),
+	}
+	page.Summary = []htmlRow{
+		{"Total", secs(rep.Total)},
+		{"Responses", strconv.Itoa(rep.Requests)},
+		{"Errors", strconv.Itoa(len(r.errStarts))},
+	}
+	if rep.Requests > 0 {
+		page.Summary = append(page.Summary,
+			htmlRow{"Slowest", secs(rep.Slowest)},
+			htmlRow{"Fastest", secs(rep.Fastest)},
+			htmlRow{"Average", secs(rep.Average)},
+			htmlRow{"Requests/sec", fmt.Sprintf("%4.4f", rep.RPS)},
+		)
+		if rep.TargetRPS > 0 {
+			page.Summary = append(page.Summary, htmlRow{"Target rate",
+				fmt.Sprintf("%4.4f req/s, sent %4.4f (%.1f%%)", rep.TargetRPS, rep.SentRPS, rep.SentRPS/rep.TargetRPS*100)})
+		}
+	}
+	if rep.SizeTotal > 0 {
+		page.Summary = append(page.Summary, htmlRow{"Total data", fmt.Sprintf("%d bytes", rep.SizeTotal)})
+	}
+	for _, l := range rep.Latencies {
+		if l.Latency > 0 {
+			page.Latencies = append(page.Latencies, htmlRow{fmt.Sprintf("%d%%", l.P), secs(l.Latency)})
+		}
+	}
+
+	codes := make([]int, 0, len(rep.StatusCodes))
+	for code := range rep.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		name := strconv.Itoa(code)
+		if r.grpc {
+			name = grpcCodeName(code)
+		}
+		page.Codes = append(page.Codes, htmlRow{name, strconv.Itoa(rep.StatusCodes[code])})
+	}
+	for msg, num := range rep.Errors {
+		page.Errors = append(page.Errors, htmlRow{msg, strconv.Itoa(num)})
+	}
+	sort.Slice(page.Errors, func(i, j int) bool { return page.Errors[i].Name < page.Errors[j].Name })
+	for _, a := range r.agents {
+		status := fmt.Sprintf("%d responses", a.requests)
+		if a.err != nil {
+			status = "failed: " + a.err.Error()
+		}
+		page.Agents = append(page.Agents, htmlRow{a.addr, status})
+	}
+
+	if len(rep.Histogram) > 0 {
+		var labels []string
+		var counts []float64
+		for _, b := range rep.Histogram {
+			labels = append(labels, fmt.Sprintf("%4.3f", b.Mark.Seconds()))
+			counts = append(counts, float64(b.Count))
+		}
+		page.Histogram = barChart(labels, counts)
+	}
+	if series := r.timeSeries(r.chartInterval()); len(series) > 0 {
+		var xs, p50, p90, p99, rps []float64
+		for _, b := range series {
+			xs = append(xs, b.start)
+			p50 = append(p50, b.p50)
+			p90 = append(p90, b.p90)
+			p99 = append(p99, b.p99)
+			rps = append(rps, b.rps)
+		}
+		page.LatencyChart = lineChart(xs, "secs", []chartSeries{
+			{"p50", "#4e79a7", p50}, {"p90", "#f28e2b", p90}, {"p99", "#e15759", p99},
+		})
+		page.RPSChart = lineChart(xs, "req/s", []chartSeries{{"responses/sec", "#59a14f", rps}})
+	}
+	return htmlTemplate.Execute(h.W, page)
+}
+
+func secs(d time.Duration) string {
+	return fmt.Sprintf("%4.4f secs", d.Seconds())
+}
+
+// workConfig lists the settings of w that are not left at their zero
+// value.
+func workConfig(w *Work) []htmlRow {
+	if w == nil {
+		return nil
+	}
+	var rows []htmlRow
+	if w.Request != nil {
+		rows = append(rows, htmlRow{"Method", w.Request.Method}, htmlRow{"URL", w.Request.URL.String()})
+		keys := make([]string, 0, len(w.Request.Header))
+		for k := range w.Request.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := strings.Join(w.Request.Header[k], ", ")
+			if k == "Authorization" {
+				v = "(hidden)"
+			}
+			rows = append(rows, htmlRow{"Header " + k, v})
+		}
+	}
+	if n := w.rows(); n > 0 {
+		rows = append(rows, htmlRow{"Input rows", strconv.Itoa(n)})
+	}
+	if w.ProxyAddr != nil {
+		rows = append(rows, htmlRow{"ProxyAddr", w.ProxyAddr.String()})
+	}
+	v := reflect.ValueOf(*w)
+	for i := 0; i < v.NumField(); i++ {
+		f, field := v.Type().Field(i), v.Field(i)
+		if !f.IsExported() || field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64, reflect.String:
+			rows = append(rows, htmlRow{f.Name, fmt.Sprint(field.Interface())})
+		}
+	}
+	return rows
+}
+
+type chartSeries struct {
+	name  string
+	color string
+	ys    []float64
+}
+
+const (
+	chartWidth  = 760
+	chartHeight = 260
+	chartLeft   = 70
+	chartRight  = 20
+	chartTop    = 20
+	chartBottom = 40
+)
+
+// chartFrame draws the axes and horizontal grid lines of a chart whose
+// values go up to ymax, and returns the rounded up ymax.
+func chartFrame(b *strings.Builder, ymax float64, unit string) float64 {
+	if ymax <= 0 {
+		ymax = 1
+	}
+	step := math.Pow(10, math.Floor(math.Log10(ymax/4)))
+	for ymax/step > 5 {
+		step *= 2
+	}
+	ymax = math.Ceil(ymax/step) * step
+	plotH := float64(chartHeight - chartTop - chartBottom)
+	for v := 0.0; v <= ymax+step/2; v += step {
+		y := chartTop + plotH - v/ymax*plotH
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" class="grid"/>`, chartLeft, y, chartWidth-chartRight, y)
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" class="yl">%s</text>`, chartLeft-6, y+4, strconv.FormatFloat(v, 'g', 4, 64))
+	}
+	fmt.Fprintf(b, `<text x="12" y="%d" class="unit" transform="rotate(-90 12 %d)">%s</text>`,
+		chartTop+int(plotH)/2, chartTop+int(plotH)/2, template.HTMLEscapeString(unit))
+	return ymax
+}
+
+// lineChart draws series over the x values xs, in seconds since the start
+// of the test.
+func lineChart(xs []float64, unit string, series []chartSeries) template.HTML {
+	var ymax float64
+	for _, s := range series {
+		for _, y := range s.ys {
+			ymax = math.Max(ymax, y)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" class="chart">`, chartWidth, chartHeight)
+	ymax = chartFrame(&b, ymax, unit)
+
+	plotW := float64(chartWidth - chartLeft - chartRight)
+	plotH := float64(chartHeight - chartTop - chartBottom)
+	xmin, xmax := xs[0], xs[len(xs)-1]
+	if xmax == xmin {
+		xmax = xmin + 1
+	}
+	xpos := func(x float64) float64 { return chartLeft + (x-xmin)/(xmax-xmin)*plotW }
+	for _, x := range []float64{xmin, (xmin + xmax) / 2, xmax} {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="xl">%ss</text>`, xpos(x), chartHeight-chartBottom+18, strconv.FormatFloat(x, 'f', 1, 64))
+	}
+	for i, s := range series {
+		var points []string
+		for j, y := range s.ys {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", xpos(xs[j]), chartTop+plotH-y/ymax*plotH))
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), s.color)
+		lx := chartWidth - chartRight - 110*(len(series)-i)
+		fmt.Fprintf(&b, `<rect x="%d" y="4" width="10" height="10" fill="%s"/><text x="%d" y="13" class="legend">%s</text>`,
+			lx, s.color, lx+14, template.HTMLEscapeString(s.name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// barChart draws one labelled bar per value.
+func barChart(labels []string, values []float64) template.HTML {
+	var ymax float64
+	for _, v := range values {
+		ymax = math.Max(ymax, v)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" class="chart">`, chartWidth, chartHeight)
+	ymax = chartFrame(&b, ymax, "responses")
+
+	plotW := float64(chartWidth - chartLeft - chartRight)
+	plotH := float64(chartHeight - chartTop - chartBottom)
+	slot := plotW / float64(len(values))
+	for i, v := range values {
+		h := v / ymax * plotH
+		x := chartLeft + float64(i)*slot
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" class="bar"><title>%s secs: %d</title></rect>`,
+			x+slot*0.1, chartTop+plotH-h, slot*0.8, h, template.HTMLEscapeString(labels[i]), int(v))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="xl">%s</text>`, x+slot/2, chartHeight-chartBottom+18, template.HTMLEscapeString(labels[i]))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"secs": secs}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>meg_sender report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 820px; color: #222; }
+h1 { font-size: 1.6em; margin-bottom: 0; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: .3em; }
+.meta { color: #777; }
+.warn { background: #fff4e5; border: 1px solid #f5c27a; padding: .6em 1em; }
+table { border-collapse: collapse; min-width: 50%; }
+td, th { text-align: left; padding: .25em 1em .25em 0; border-bottom: 1px solid #eee; vertical-align: top; }
+td.num, th.num { text-align: right; }
+.chart { width: 100%; height: auto; }
+.chart text { font-size: 11px; fill: #555; }
+.chart .yl { text-anchor: end; }
+.chart .xl { text-anchor: middle; }
+.chart .unit { text-anchor: middle; }
+.chart .grid { stroke: #e5e5e5; }
+.chart .bar { fill: #4e79a7; }
+</style>
+</head>
+<body>
+<h1>meg_sender report</h1>
+<p class="meta">Generated {{.Generated}}</p>
+{{if .Interrupted}}<p class="warn">The test was interrupted; the report covers the requests completed so far.</p>{{end}}
+
+<h2>Summary</h2>
+<table>{{range .Summary}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+
+{{if .LatencyChart}}<h2>Latency over time</h2>
+{{.LatencyChart}}
+<h2>Requests per second over time</h2>
+{{.RPSChart}}{{end}}
+
+{{if .Histogram}}<h2>Response time histogram</h2>
+{{.Histogram}}{{end}}
+
+{{if .Latencies}}<h2>Latency distribution</h2>
+<table>{{range .Latencies}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>{{end}}
+
+{{if .Phases}}<h2>Phases</h2>
+<table>
+<tr><th>Phase</th><th class="num">Average</th><th class="num">Fastest</th><th class="num">Slowest</th></tr>
+{{range .Phases}}<tr><td>{{.Name}}</td><td class="num">{{secs .Average}}</td><td class="num">{{secs .Fastest}}</td><td class="num">{{secs .Slowest}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .Codes}}<h2>Status codes</h2>
+<table>
+<tr><th>Code</th><th class="num">Responses</th></tr>
+{{range .Codes}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .Errors}}<h2>Errors</h2>
+<table>
+<tr><th>Error</th><th class="num">Requests</th></tr>
+{{range .Errors}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .Agents}}<h2>Agents</h2>
+<table>{{range .Agents}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>{{end}}
+
+<h2>Configuration</h2>
+<table>{{range .Config}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,92 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// InfluxSink writes results to InfluxDB in line protocol, one point per
+// request in the measurement meg_request. Points are tagged with test, tag,
+// and code or error class; their fields are the phase durations in seconds
+// and the response size.
+type InfluxSink struct {
+	// URL is the write endpoint with its parameters, such as
+	// http://localhost:8086/api/v2/write?org=o&bucket=b&precision=ns or
+	// http://localhost:8086/write?db=load for InfluxDB 1.
+	URL string
+
+	// Token, if set, is sent in the Authorization header.
+	Token string
+
+	// Test is the value of the test tag.
+	Test string
+
+	// Client makes the requests. If nil, a client with a 10s timeout is
+	// used.
+	Client *http.Client
+}
+
+func (s *InfluxSink) String() string {
+	return "influxdb " + s.URL
+}
+
+func (s *InfluxSink) Write(results []Result) error {
+	var buf bytes.Buffer
+	for _, res := range results {
+		buf.WriteString("meg_request")
+		writeInfluxTag(&buf, "test", s.Test)
+		writeInfluxTag(&buf, "tag", res.Tag)
+		if res.Err != nil {
+			writeInfluxTag(&buf, "error", errorClass(res.Err))
+			buf.WriteString(" failed=1i")
+		} else {
+			writeInfluxTag(&buf, "code", strconv.Itoa(res.StatusCode))
+			buf.WriteString(" duration=" + formatSeconds(res.Duration.Seconds()))
+			buf.WriteString(",dns=" + formatSeconds(res.DNSDuration.Seconds()))
+			buf.WriteString(",dialup=" + formatSeconds(res.ConnDuration.Seconds()))
+			buf.WriteString(",tls=" + formatSeconds(res.TLSDuration.Seconds()))
+			buf.WriteString(",request_write=" + formatSeconds(res.ReqDuration.Seconds()))
+			buf.WriteString(",response_wait=" + formatSeconds(res.DelayDuration.Seconds()))
+			buf.WriteString(",response_read=" + formatSeconds(res.ResDuration.Seconds()))
+			buf.WriteString(",size=" + strconv.FormatInt(res.ContentLength, 10) + "i")
+		}
+		buf.WriteString(" " + strconv.FormatInt(res.Start.UnixNano(), 10) + "\n")
+	}
+
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if s.Token != "" {
+		header.Set("Authorization", "Token "+s.Token)
+	}
+	return postBatch(s.Client, s.URL, header, buf.Bytes())
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// writeInfluxTag appends a tag, leaving out empty values, which line
+// protocol does not allow.
+func writeInfluxTag(buf *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteString("," + key + "=" + influxEscaper.Replace(value))
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', -1, 64)
+}
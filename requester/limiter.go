@@ -0,0 +1,90 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket shared by all workers. It fills at rate tokens
+// per second up to burst and every request takes a token. Rather than
+// counting tokens, it keeps the time the next token is due, in nanoseconds
+// since start as a float so that no rounding accumulates at high rates.
+//
+// A worker that is late for its token, e.g. because its timer fired late,
+// may only catch up within the burst. At high QPS a burst of a few
+// milliseconds' worth of tokens keeps the rate when timers are coarse.
+type limiter struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	start    time.Time
+	interval float64 // nanoseconds per token
+	slack    float64 // how far the next token may lie in the past, for bursts
+	next     float64
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return newLimiterAt(rate, burst, time.Now)
+}
+
+// newLimiterAt returns a limiter reading the time from now.
+func newLimiterAt(rate float64, burst int, now func() time.Time) *limiter {
+	interval := 1e9 / rate
+	slack := float64(max(burst, 1)-1) * interval
+	// The bucket starts full.
+	return &limiter{now: now, start: now(), interval: interval, slack: slack, next: -slack}
+}
+
+// reserve takes the next token and returns how long to wait for it.
+func (l *limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := float64(l.now().Sub(l.start))
+	t := math.Max(l.next, now-l.slack)
+	l.next = t + l.interval
+	return time.Duration(t - now)
+}
+
+// wait blocks until the next token is due. It returns false if done is
+// closed first.
+func (l *limiter) wait(done <-chan struct{}) bool {
+	d := l.reserve()
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// sendRate returns the QPS of the test and the rate requests were sent at,
+// or zeros if the test has no QPS.
+func (r *report) sendRate() (target, sent float64) {
+	if r.work == nil || r.work.QPS <= 0 || r.timeUsed <= 0 {
+		return 0, 0
+	}
+	n := len(r.lats)
+	for _, num := range r.errorDist {
+		n += num
+	}
+	return r.work.QPS, float64(n) / r.timeUsed.Seconds()
+}
@@ -3,21 +3,45 @@ package requester
 import (
 	"io"
 	"log"
-	"os"
+	"log/slog"
 )
 
+// Info prints the responses, Warning and Error report problems and Debug
+// traces the test. They discard everything by default, so that the package
+// prints nothing of its own; set their output, or call SetLogger to route
+// them through a structured logger. Responses are only read for printing
+// while Info writes somewhere.
 var (
-	Info    *log.Logger
-	Warning *log.Logger
-	Error   *log.Logger
+	Debug   = log.New(io.Discard, "", 0)
+	Info    = log.New(io.Discard, "", 0)
+	Warning = log.New(io.Discard, "", 0)
+	Error   = log.New(io.Discard, "", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
-func init() {
-	errFile, err := os.OpenFile("log.stderr", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln("打开日志文件失败：", err)
+// SetLogger routes Debug, Info, Warning and Error through l at the
+// matching levels, so that l's level decides what is printed. The loggers
+// are redirected in place, so it is safe to call while a test runs.
+func SetLogger(l *slog.Logger) {
+	h := l.Handler()
+	route(Debug, h, slog.LevelDebug)
+	route(Info, h, slog.LevelInfo)
+	route(Warning, h, slog.LevelWarn)
+	route(Error, h, slog.LevelError)
+}
+
+// route makes lg write its messages as records at level to h.
+func route(lg *log.Logger, h slog.Handler, level slog.Level) {
+	lg.SetOutput(slog.NewLogLogger(h, level).Writer())
+	lg.SetFlags(0)
+	lg.SetPrefix("")
+}
+
+// NewLogger returns a logger writing the records at level and above to w,
+// as JSON objects if json is set and as key=value text otherwise.
+func NewLogger(w io.Writer, level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
 	}
-	Info = log.New(io.MultiWriter(os.Stdout), "", 0)
-	Warning = log.New(io.MultiWriter(os.Stdout), "", 0)
-	Error = log.New(io.MultiWriter(os.Stderr, errFile), "", log.Ldate|log.Ltime|log.Lshortfile)
+	return slog.New(slog.NewTextHandler(w, opts))
 }
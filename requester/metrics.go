@@ -0,0 +1,176 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exposes the progress of running tests to Prometheus. All its
+// methods are safe to call on a nil *Metrics, which records nothing.
+type Metrics struct {
+	requests   *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	inFlight   *prometheus.GaugeVec
+	workers    *prometheus.GaugeVec
+	targetRPS  *prometheus.GaugeVec
+	achieveRPS *prometheus.GaugeVec
+}
+
+// NewMetrics creates the metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "meg_requests_total",
+			Help: "Responses received, by status code.",
+		}, []string{"test", "tag", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "meg_errors_total",
+			Help: "Requests that failed without a response, by error class.",
+		}, []string{"test", "tag", "class"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "meg_request_duration_seconds",
+			Help:    "Duration of the requests and of their trace phases.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"test", "tag", "phase"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "meg_in_flight_requests",
+			Help: "Requests sent and not yet answered.",
+		}, []string{"test"}),
+		workers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "meg_active_workers",
+			Help: "Workers sending requests.",
+		}, []string{"test"}),
+		targetRPS: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "meg_target_rps",
+			Help: "Configured rate limit in requests per second, 0 if unlimited.",
+		}, []string{"test"}),
+		achieveRPS: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "meg_achieved_rps",
+			Help: "Requests completed per second over the last second.",
+		}, []string{"test"}),
+	}
+	reg.MustRegister(m.requests, m.errors, m.durations, m.inFlight, m.workers, m.targetRPS, m.achieveRPS)
+	return m
+}
+
+// observe records a completed request.
+func (m *Metrics) observe(test string, res *Result) {
+	if m == nil {
+		return
+	}
+	if res.Err != nil {
+		m.errors.WithLabelValues(test, res.Tag, errorClass(res.Err)).Inc()
+		return
+	}
+	m.requests.WithLabelValues(test, res.Tag, strconv.Itoa(res.StatusCode)).Inc()
+	for _, p := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"total", res.Duration},
+		{"dns", res.DNSDuration},
+		{"dialup", res.ConnDuration},
+		{"tls", res.TLSDuration},
+		{"request_write", res.ReqDuration},
+		{"response_wait", res.DelayDuration},
+		{"response_read", res.ResDuration},
+	} {
+		m.durations.WithLabelValues(test, res.Tag, p.name).Observe(p.d.Seconds())
+	}
+}
+
+// request counts a request in flight until the returned func is called.
+func (m *Metrics) request(test string) func() {
+	if m == nil {
+		return func() {}
+	}
+	g := m.inFlight.WithLabelValues(test)
+	g.Inc()
+	return g.Dec
+}
+
+// worker counts an active worker until the returned func is called.
+func (m *Metrics) worker(test string) func() {
+	if m == nil {
+		return func() {}
+	}
+	g := m.workers.WithLabelValues(test)
+	g.Inc()
+	return g.Dec
+}
+
+// watch sets the target rate and updates the achieved rate every second
+// from the number of completed requests until ctx is done.
+func (m *Metrics) watch(ctx context.Context, test string, qps float64, completed *int64) {
+	if m == nil {
+		return
+	}
+	m.targetRPS.WithLabelValues(test).Set(qps)
+	achieved := m.achieveRPS.WithLabelValues(test)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		last, lastTime := atomic.LoadInt64(completed), time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				achieved.Set(0)
+				return
+			case now := <-ticker.C:
+				n := atomic.LoadInt64(completed)
+				achieved.Set(float64(n-last) / now.Sub(lastTime).Seconds())
+				last, lastTime = n, now
+			}
+		}
+	}()
+}
+
+// errorClass sorts an error into a few classes suitable as a label.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth), errors.As(err, &recordErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
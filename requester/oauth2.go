@@ -0,0 +1,220 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2Config gets bearer tokens with the OAuth2 client credentials grant.
+// A token is fetched before the test starts and refreshed in the
+// background before it expires, while the workers keep using the old one.
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// SecretInBody sends the client credentials as form fields instead of
+	// with HTTP basic authentication.
+	SecretInBody bool
+}
+
+// TokenStats tells how the token endpoint was used. Its calls are not
+// part of the load test results.
+type TokenStats struct {
+	// Requests is the number of token requests and Failed the number that
+	// got no token.
+	Requests int
+	Failed   int
+
+	// Total is the time spent in token requests and Slowest the longest.
+	Total   time.Duration
+	Slowest time.Duration
+}
+
+func (s *TokenStats) merge(o *TokenStats) {
+	s.Requests += o.Requests
+	s.Failed += o.Failed
+	s.Total += o.Total
+	s.Slowest = max(s.Slowest, o.Slowest)
+}
+
+// tokenSource holds the current token and refreshes it.
+type tokenSource struct {
+	conf   *OAuth2Config
+	client *http.Client
+
+	mu    sync.Mutex
+	token string
+	next  time.Time // when to refresh the token, zero if it does not expire
+	stats TokenStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// oauth2Retry is how long to wait before trying again after a failed
+// refresh.
+const oauth2Retry = time.Second
+
+// startOAuth2 fetches the first token and starts refreshing it. It fails if
+// no token can be had.
+func (b *Work) startOAuth2() error {
+	ts := &tokenSource{
+		conf:   b.OAuth2,
+		client: &http.Client{Timeout: b.SingleRequestTimeout},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := ts.fetch(b.context()); err != nil {
+		return fmt.Errorf("oauth2: %v", err)
+	}
+	b.tokens = ts
+	go ts.refresh(b.context())
+	return nil
+}
+
+// current returns the token to send.
+func (ts *tokenSource) current() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.token
+}
+
+// refresh fetches a new token once four fifths of the lifetime of the
+// current one are over, until close is called. The workers keep sending
+// the current token meanwhile.
+func (ts *tokenSource) refresh(ctx context.Context) {
+	defer close(ts.done)
+	for {
+		ts.mu.Lock()
+		next := ts.next
+		ts.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ts.stop:
+			return
+		}
+		if err := ts.fetch(ctx); err != nil {
+			Warning.Printf("oauth2: refreshing the token: %v\n", err)
+		}
+	}
+}
+
+// close stops the refreshing and returns the token endpoint statistics.
+func (ts *tokenSource) close() *TokenStats {
+	close(ts.stop)
+	<-ts.done
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	s := ts.stats
+	return &s
+}
+
+// fetch asks the token endpoint for a new token.
+func (ts *tokenSource) fetch(ctx context.Context) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(ts.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.conf.Scopes, " "))
+	}
+	if ts.conf.SecretInBody {
+		form.Set("client_id", ts.conf.ClientID)
+		form.Set("client_secret", ts.conf.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !ts.conf.SecretInBody {
+		req.SetBasicAuth(url.QueryEscape(ts.conf.ClientID), url.QueryEscape(ts.conf.ClientSecret))
+	}
+
+	s := time.Now()
+	token, expiresIn, err := ts.do(req)
+	d := time.Now().Sub(s)
+	Debug.Printf("oauth2: token request took %v\n", d)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.stats.Requests++
+	ts.stats.Total += d
+	ts.stats.Slowest = max(ts.stats.Slowest, d)
+	if err != nil {
+		ts.stats.Failed++
+		ts.next = time.Now().Add(oauth2Retry)
+		return err
+	}
+	ts.token = token
+	ts.next = time.Time{}
+	if expiresIn > 0 {
+		ts.next = s.Add(time.Duration(expiresIn) * time.Second * 4 / 5)
+	}
+	return nil
+}
+
+// do sends the token request and returns the token and its lifetime in
+// seconds.
+func (ts *tokenSource) do(req *http.Request) (string, int64, error) {
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	json.Unmarshal(body, &tok)
+	if resp.StatusCode/100 != 2 {
+		if tok.Error != "" {
+			return "", 0, fmt.Errorf("token endpoint returned %s: %s", resp.Status, tok.Error)
+		}
+		return "", 0, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if tok.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint returned no access_token")
+	}
+	return tok.AccessToken, tok.ExpiresIn, nil
+}
+
+// printToken prints how the token endpoint was used.
+func (r *report) printToken() {
+	s := r.token
+	r.printf("\nToken endpoint:\n")
+	r.printf("  Requests:\t%d, %d failed\n", s.Requests, s.Failed)
+	if s.Requests > 0 {
+		r.printf("  Average:\t%4.4f secs\n", s.Total.Seconds()/float64(s.Requests))
+		r.printf("  Slowest:\t%4.4f secs\n", s.Slowest.Seconds())
+	}
+}
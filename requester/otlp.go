@@ -0,0 +1,210 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// otlpBounds are the upper bounds in seconds of the duration histogram
+// buckets.
+var otlpBounds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// OTLPSink exports results as OpenTelemetry metrics over OTLP/HTTP with
+// JSON encoding. Every batch is exported as delta counts: meg.requests by
+// code, meg.errors by error class and the meg.request.duration histogram,
+// all with test and tag attributes.
+type OTLPSink struct {
+	// URL is the metrics endpoint of the collector, such as
+	// http://localhost:4318/v1/metrics.
+	URL string
+
+	// Header is sent with every export, e.g. for authentication.
+	Header http.Header
+
+	// Test is the value of the test attribute.
+	Test string
+
+	// Client makes the requests. If nil, a client with a 10s timeout is
+	// used.
+	Client *http.Client
+}
+
+func (s *OTLPSink) String() string {
+	return "otlp " + s.URL
+}
+
+// The OTLP/JSON encoding of the metrics data model. 64-bit integers are
+// encoded as strings.
+type (
+	otlpExport struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name      string         `json:"name"`
+		Unit      string         `json:"unit"`
+		Sum       *otlpSum       `json:"sum,omitempty"`
+		Histogram *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpAttribute `json:"attributes"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsInt             string          `json:"asInt"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpAttribute `json:"attributes"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpDelta is the aggregation temporality of counts since the previous
+// export.
+const otlpDelta = 1
+
+func (s *OTLPSink) Write(results []Result) error {
+	type key struct{ tag, label string }
+	type hist struct {
+		count  int64
+		sum    float64
+		counts []int64
+	}
+	requests := make(map[key]int64)
+	errs := make(map[key]int64)
+	durations := make(map[string]*hist)
+	start := time.Now()
+	for _, res := range results {
+		if res.Start.Before(start) {
+			start = res.Start
+		}
+		if res.Err != nil {
+			errs[key{res.Tag, errorClass(res.Err)}]++
+			continue
+		}
+		requests[key{res.Tag, strconv.Itoa(res.StatusCode)}]++
+		h := durations[res.Tag]
+		if h == nil {
+			h = &hist{counts: make([]int64, len(otlpBounds)+1)}
+			durations[res.Tag] = h
+		}
+		d := res.Duration.Seconds()
+		h.count++
+		h.sum += d
+		h.counts[sort.SearchFloat64s(otlpBounds, d)]++
+	}
+
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(time.Now().UnixNano(), 10)
+	attrs := func(tag, k, v string) []otlpAttribute {
+		as := []otlpAttribute{{"test", otlpValue{s.Test}}, {"tag", otlpValue{tag}}}
+		if k != "" {
+			as = append(as, otlpAttribute{k, otlpValue{v}})
+		}
+		return as
+	}
+	counter := func(name string, counts map[key]int64, label string) otlpMetric {
+		sum := &otlpSum{AggregationTemporality: otlpDelta, IsMonotonic: true}
+		for k, n := range counts {
+			sum.DataPoints = append(sum.DataPoints, otlpNumberPoint{
+				Attributes:        attrs(k.tag, label, k.label),
+				StartTimeUnixNano: startNano,
+				TimeUnixNano:      nowNano,
+				AsInt:             strconv.FormatInt(n, 10),
+			})
+		}
+		return otlpMetric{Name: name, Unit: "1", Sum: sum}
+	}
+
+	var metrics []otlpMetric
+	if len(requests) > 0 {
+		metrics = append(metrics, counter("meg.requests", requests, "code"))
+	}
+	if len(errs) > 0 {
+		metrics = append(metrics, counter("meg.errors", errs, "error"))
+	}
+	if len(durations) > 0 {
+		h := &otlpHistogram{AggregationTemporality: otlpDelta}
+		for tag, d := range durations {
+			p := otlpHistogramPoint{
+				Attributes:        attrs(tag, "", ""),
+				StartTimeUnixNano: startNano,
+				TimeUnixNano:      nowNano,
+				Count:             strconv.FormatInt(d.count, 10),
+				Sum:               d.sum,
+				ExplicitBounds:    otlpBounds,
+			}
+			for _, n := range d.counts {
+				p.BucketCounts = append(p.BucketCounts, strconv.FormatInt(n, 10))
+			}
+			h.DataPoints = append(h.DataPoints, p)
+		}
+		metrics = append(metrics, otlpMetric{Name: "meg.request.duration", Unit: "s", Histogram: h})
+	}
+
+	body, err := json.Marshal(otlpExport{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{"service.name", otlpValue{"meg_sender"}}}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "meg_sender"},
+			Metrics: metrics,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	for k, v := range s.Header {
+		header[k] = v
+	}
+	return postBatch(s.Client, s.URL, header, body)
+}
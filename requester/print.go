@@ -19,6 +19,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,139 +36,283 @@ type report struct {
 
 	avgConn   float64
 	avgDNS    float64
+	avgTLS    float64
 	avgReq    float64
 	avgRes    float64
 	avgDelay  float64
 	connLats  []float64
 	dnsLats   []float64
+	tlsLats   []float64
 	reqLats   []float64
 	resLats   []float64
 	delayLats []float64
 
-	results  chan *result
+	results  chan *Result
+	onResult func(Result)
 	timeUsed time.Duration
 
+	streams        int
+	truncated      int
+	firstEventLats []float64
+	eventGapLats   []float64
+	eventCounts    []float64
+
 	errorDist      map[string]int
 	statusCodeDist map[int]int
 	lats           []float64
+	starts         []float64 // start of the requests in lats, in seconds since startTime
+	codes          []int     // status codes of the responses in lats
+	errStarts      []float64 // start of the failed requests
+	sorted         []float64 // lats in ascending order, set by calculate
 	sizeTotal      int64
 
-	output string
+	h2Conns []*h2Conn
+	ws      *wsStats
+	grpc    bool
+	agents  []agentStatus
+	work    *Work // the test, for renderers listing its configuration
+
+	retries   *RetryStats // set if the Work has a RetryPolicy
+	hedges    *HedgeStats // set if the Work hedges requests
+	think     *ThinkStats // set if the Work has think time or pacing
+	groups    map[string]*groupStats
+	token     *TokenStats // set if the Work has OAuth2
+	sinks     []*sinkWriter
+	sinkStats []SinkStats
 
-	w         io.Writer
-	exit      bool
-	startTime time.Time
+	w           io.Writer
+	err         error // first error writing to w
+	interrupted bool
+	done        chan struct{} // closed once all results are aggregated
+	startTime   time.Time
 }
 
-func newReport(w io.Writer, results chan *result, output string) *report {
+func newReport(results chan *Result, onResult func(Result)) *report {
 	return &report{
-		w:              w,
-		output:         output,
 		results:        results,
+		onResult:       onResult,
 		statusCodeDist: make(map[int]int),
 		errorDist:      make(map[string]int),
-		exit:           false,
 	}
 }
 
+// start collects results until the results channel is closed.
 func (r *report) start() {
 	r.startTime = time.Now()
+	r.done = make(chan struct{})
 	go func() {
-		for !r.exit {
-			select {
-			case res, hasMore := <-r.results:
-				if !hasMore {
-					break
-				}
-				if res.err != nil {
-					r.errorDist[res.err.Error()]++
-				} else {
-					r.lats = append(r.lats, res.duration.Seconds())
-					r.avgTotal += res.duration.Seconds()
-					r.avgConn += res.connDuration.Seconds()
-					r.avgDelay += res.delayDuration.Seconds()
-					r.avgDNS += res.dnsDuration.Seconds()
-					r.avgReq += res.reqDuration.Seconds()
-					r.avgRes += res.resDuration.Seconds()
-					r.connLats = append(r.connLats, res.connDuration.Seconds())
-					r.dnsLats = append(r.dnsLats, res.dnsDuration.Seconds())
-					r.reqLats = append(r.reqLats, res.reqDuration.Seconds())
-					r.delayLats = append(r.delayLats, res.delayDuration.Seconds())
-					r.resLats = append(r.resLats, res.resDuration.Seconds())
-					r.statusCodeDist[res.statusCode]++
-					if res.contentLength > 0 {
-						r.sizeTotal += res.contentLength
-					}
-				}
-			}
+		for res := range r.results {
+			r.add(res)
 		}
+		close(r.done)
 	}()
 }
 
+// add aggregates a single result. It is only called from the goroutine
+// started by start, so the report needs no locking.
+func (r *report) add(res *Result) {
+	if r.onResult != nil {
+		r.onResult(*res)
+	}
+	for _, sw := range r.sinks {
+		sw.feed(*res)
+	}
+	if r.retries != nil {
+		r.retries.add(res)
+	}
+	if r.hedges != nil {
+		r.hedges.add(res)
+	}
+	if res.Group != "" {
+		r.addGroup(res)
+	}
+	if res.Err != nil {
+		r.errorDist[res.Err.Error()]++
+		r.errStarts = append(r.errStarts, res.Start.Sub(r.startTime).Seconds())
+		return
+	}
+	r.lats = append(r.lats, res.Duration.Seconds())
+	r.starts = append(r.starts, res.Start.Sub(r.startTime).Seconds())
+	r.codes = append(r.codes, res.StatusCode)
+	r.avgTotal += res.Duration.Seconds()
+	r.avgConn += res.ConnDuration.Seconds()
+	r.avgDelay += res.DelayDuration.Seconds()
+	r.avgDNS += res.DNSDuration.Seconds()
+	r.avgTLS += res.TLSDuration.Seconds()
+	r.avgReq += res.ReqDuration.Seconds()
+	r.avgRes += res.ResDuration.Seconds()
+	r.connLats = append(r.connLats, res.ConnDuration.Seconds())
+	r.dnsLats = append(r.dnsLats, res.DNSDuration.Seconds())
+	r.tlsLats = append(r.tlsLats, res.TLSDuration.Seconds())
+	r.reqLats = append(r.reqLats, res.ReqDuration.Seconds())
+	r.delayLats = append(r.delayLats, res.DelayDuration.Seconds())
+	r.resLats = append(r.resLats, res.ResDuration.Seconds())
+	r.statusCodeDist[res.StatusCode]++
+	if res.ContentLength > 0 {
+		r.sizeTotal += res.ContentLength
+	}
+	if res.stream != nil {
+		r.addStream(res.stream)
+	}
+}
+
+func (r *report) addStream(st *streamResult) {
+	r.streams++
+	if st.truncated {
+		r.truncated++
+	}
+	r.eventCounts = append(r.eventCounts, float64(st.events))
+	if st.events > 0 {
+		r.firstEventLats = append(r.firstEventLats, st.firstEvent.Seconds())
+	}
+	for _, gap := range st.gaps {
+		r.eventGapLats = append(r.eventGapLats, gap.Seconds())
+	}
+}
+
+// stop waits for the results sent so far to be aggregated. The results
+// channel must be closed first.
 func (r *report) stop() {
-	r.exit = true
 	r.timeUsed = time.Now().Sub(r.startTime)
-	time.Sleep(time.Microsecond)
+	<-r.done
+	for _, sw := range r.sinks {
+		r.sinkStats = append(r.sinkStats, sw.close())
+	}
 
+	r.calculate()
+}
+
+// calculate turns the sums collected so far into averages.
+func (r *report) calculate() {
+	r.sorted = append([]float64(nil), r.lats...)
+	sort.Float64s(r.sorted)
+	if len(r.sorted) > 0 {
+		r.fastest = r.sorted[0]
+		r.slowest = r.sorted[len(r.sorted)-1]
+	}
 	r.rps = float64(len(r.lats)) / r.timeUsed.Seconds()
 	r.average = r.avgTotal / float64(len(r.lats))
 	r.avgConn = r.avgConn / float64(len(r.lats))
 	r.avgDelay = r.avgDelay / float64(len(r.lats))
 	r.avgDNS = r.avgDNS / float64(len(r.lats))
+	r.avgTLS = r.avgTLS / float64(len(r.lats))
 	r.avgReq = r.avgReq / float64(len(r.lats))
 	r.avgRes = r.avgRes / float64(len(r.lats))
-
-	r.finalize()
 }
 
 func (r *report) printCSV() {
-	r.printf("response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read\n")
+	r.printf("response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,offset,timestamp\n")
 	for i, val := range r.lats {
-		r.printf("%4.4f,%4.4f,%4.4f,%4.4f,%4.4f,%4.4f\n",
-			val, r.connLats[i], r.dnsLats[i], r.reqLats[i], r.delayLats[i], r.resLats[i])
+		sent := r.startTime.Add(seconds(r.starts[i]))
+		r.printf("%4.4f,%4.4f,%4.4f,%4.4f,%4.4f,%4.4f,%4.4f,%s\n",
+			val, r.connLats[i], r.dnsLats[i], r.reqLats[i], r.delayLats[i], r.resLats[i],
+			r.starts[i], sent.Format(time.RFC3339Nano))
 	}
 }
 
 func (r *report) finalize() {
-	if r.output == "csv" {
-		r.printCSV()
-		return
+	if r.interrupted {
+		r.printf("\nInterrupted, the report covers the requests completed so far.\n")
 	}
-
 	if len(r.lats) > 0 {
-		sort.Float64s(r.lats)
-		r.fastest = r.lats[0]
-		r.slowest = r.lats[len(r.lats)-1]
 		r.printf("\nSummary:\n")
 		r.printf("  Total:\t%4.4f secs\n", r.timeUsed.Seconds())
 		r.printf("  Slowest:\t%4.4f secs\n", r.slowest)
 		r.printf("  Fastest:\t%4.4f secs\n", r.fastest)
 		r.printf("  Average:\t%4.4f secs\n", r.average)
 		r.printf("  Requests/sec:\t%4.4f\n", r.rps)
+		if target, sent := r.sendRate(); target > 0 {
+			r.printf("  Target rate:\t%4.4f req/s, sent %4.4f (%.1f%%)\n", target, sent, sent/target*100)
+		}
 		if r.sizeTotal > 0 {
 			r.printf("  Total data:\t%d bytes\n", r.sizeTotal)
 			r.printf("  Size/request:\t%d bytes\n", r.sizeTotal/int64(len(r.lats)))
 		}
-		r.printf("\nDetailed Report:\n")
-		r.printSection("DNS+dialup", r.avgConn, r.connLats)
-		r.printSection("DNS-lookup", r.avgDNS, r.dnsLats)
-		r.printSection("Request Write", r.avgReq, r.reqLats)
-		r.printSection("Response Wait", r.avgDelay, r.delayLats)
-		r.printSection("Response Read", r.avgRes, r.resLats)
+		if !r.grpc {
+			r.printDetails()
+		}
 		r.printStatusCodes()
+		if len(r.h2Conns) > 0 {
+			r.printH2Conns()
+		}
 		r.printHistogram()
 		r.printLatencies()
+		if r.streams > 0 {
+			r.printStreams()
+		}
+	}
+
+	if r.ws != nil {
+		r.printWebSocket()
 	}
 
 	if len(r.errorDist) > 0 {
 		r.printErrors()
 	}
+
+	if len(r.groups) > 0 {
+		r.printGroups()
+	}
+
+	if r.retries != nil {
+		r.printRetries()
+	}
+
+	if r.hedges != nil {
+		r.printHedges()
+	}
+
+	if r.think != nil {
+		r.printThink()
+	}
+
+	if r.token != nil {
+		r.printToken()
+	}
+
+	if len(r.agents) > 0 {
+		r.printAgents()
+	}
+
+	if len(r.sinkStats) > 0 {
+		r.printSinks()
+	}
+}
+
+// phase is the timing of one http-trace phase over all requests.
+type phase struct {
+	name string
+	avg  float64
+	lats []float64
+}
+
+// phases returns the http-trace phases that apply to the test.
+func (r *report) phases() []phase {
+	var ps []phase
+	if r.ws == nil {
+		ps = append(ps, phase{"DNS+dialup", r.avgConn, r.connLats}, phase{"DNS-lookup", r.avgDNS, r.dnsLats})
+		if r.avgTLS > 0 {
+			ps = append(ps, phase{"TLS handshake", r.avgTLS, r.tlsLats})
+		}
+	}
+	ps = append(ps, phase{"Request Write", r.avgReq, r.reqLats}, phase{"Response Wait", r.avgDelay, r.delayLats})
+	if r.ws == nil {
+		ps = append(ps, phase{"Response Read", r.avgRes, r.resLats})
+	}
+	return ps
+}
+
+// printDetails prints the http-trace phases.
+func (r *report) printDetails() {
+	r.printf("\nDetailed Report:\n")
+	for _, p := range r.phases() {
+		r.printSection(p.name, p.avg, p.lats)
+	}
 }
 
 // printSection prints details for http-trace fields
 func (r *report) printSection(tag string, avg float64, lats []float64) {
-	sort.Float64s(lats)
-	fastest, slowest := lats[0], lats[len(lats)-1]
+	fastest, slowest := minMax(lats)
 	r.printf("\n\t%s:\n", tag)
 	r.printf("  \t\tAverage:\t%4.4f secs\n", avg)
 	r.printf("  \t\tFastest:\t%4.4f secs\n", fastest)
@@ -177,24 +322,94 @@ func (r *report) printSection(tag string, avg float64, lats []float64) {
 // printLatencies prints percentile latencies.
 func (r *report) printLatencies() {
 	pctls := []int{10, 25, 50, 75, 90, 95, 99}
+	data := percentiles(r.sorted, pctls)
+	r.printf("\nLatency distribution:\n")
+	for i := 0; i < len(pctls); i++ {
+		if data[i] > 0 {
+			r.printf("  %v%% in %4.4f secs\n", pctls[i], data[i])
+		}
+	}
+}
+
+// percentiles returns the values at pctls in the sorted slice lats.
+func percentiles(lats []float64, pctls []int) []float64 {
 	data := make([]float64, len(pctls))
 	j := 0
-	for i := 0; i < len(r.lats) && j < len(pctls); i++ {
-		current := i * 100 / len(r.lats)
+	for i := 0; i < len(lats) && j < len(pctls); i++ {
+		current := i * 100 / len(lats)
 		if current >= pctls[j] {
-			data[j] = r.lats[i]
+			data[j] = lats[i]
 			j++
 		}
 	}
-	r.printf("\nLatency distribution:\n")
-	for i := 0; i < len(pctls); i++ {
-		if data[i] > 0 {
-			r.printf("  %v%% in %4.4f secs\n", pctls[i], data[i])
+	return data
+}
+
+// printStreams prints the per-event metrics of streamed responses.
+func (r *report) printStreams() {
+	r.printf("\nStreaming:\n")
+	r.printf("  Streams:\t%d\n", r.streams)
+	if r.truncated > 0 {
+		r.printf("  Cut off:\t%d streams reached the max stream duration\n", r.truncated)
+	}
+	sort.Float64s(r.eventCounts)
+	r.printf("  Events/response:\t%4.2f average, %d min, %d max\n",
+		mean(r.eventCounts), int(r.eventCounts[0]), int(r.eventCounts[len(r.eventCounts)-1]))
+	r.printf("  Stream duration:\t%4.4f secs average\n", r.average)
+	if len(r.firstEventLats) > 0 {
+		r.printSection("Time to first event", mean(r.firstEventLats), r.firstEventLats)
+	}
+	if len(r.eventGapLats) > 0 {
+		sort.Float64s(r.eventGapLats)
+		r.printSection("Inter-event gap", mean(r.eventGapLats), r.eventGapLats)
+		pctls := []int{50, 90, 99}
+		data := percentiles(r.eventGapLats, pctls)
+		for i := range pctls {
+			r.printf("  \t\t%v%%:\t%4.4f secs\n", pctls[i], data[i])
 		}
 	}
 }
 
+func mean(vals []float64) float64 {
+	return sum(vals) / float64(len(vals))
+}
+
+// minMax returns the smallest and largest of vals, which must not be empty.
+func minMax(vals []float64) (float64, float64) {
+	min, max := vals[0], vals[0]
+	for _, v := range vals[1:] {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return min, max
+}
+
 func (r *report) printHistogram() {
+	buckets, counts := r.histogram()
+	var max int
+	for _, c := range counts {
+		if max < c {
+			max = c
+		}
+	}
+	r.printf("\nResponse time histogram:\n")
+	for i := 0; i < len(buckets); i++ {
+		// Normalize bar lengths.
+		var barLen int
+		if max > 0 {
+			barLen = (counts[i]*40 + max/2) / max
+		}
+		r.printf("  %4.3f [%v]\t|%v\n", buckets[i], counts[i], strings.Repeat(barChar, barLen))
+	}
+}
+
+// histogram splits the latencies into ten buckets between the fastest and
+// the slowest and counts the latencies up to each bucket's upper mark.
+func (r *report) histogram() ([]float64, []int) {
 	bc := 10
 	buckets := make([]float64, bc+1)
 	counts := make([]int, bc+1)
@@ -204,34 +419,72 @@ func (r *report) printHistogram() {
 	}
 	buckets[bc] = r.slowest
 	var bi int
-	var max int
-	for i := 0; i < len(r.lats); {
-		if r.lats[i] <= buckets[bi] {
+	for i := 0; i < len(r.sorted); {
+		if r.sorted[i] <= buckets[bi] {
 			i++
 			counts[bi]++
-			if max < counts[bi] {
-				max = counts[bi]
-			}
 		} else if bi < len(buckets)-1 {
 			bi++
 		}
 	}
-	r.printf("\nResponse time histogram:\n")
-	for i := 0; i < len(buckets); i++ {
-		// Normalize bar lengths.
-		var barLen int
-		if max > 0 {
-			barLen = (counts[i]*40 + max/2) / max
-		}
-		r.printf("  %4.3f [%v]\t|%v\n", buckets[i], counts[i], strings.Repeat(barChar, barLen))
-	}
+	return buckets, counts
 }
 
 // printStatusCodes prints status code distribution.
 func (r *report) printStatusCodes() {
 	r.printf("\nStatus code distribution:\n")
 	for code, num := range r.statusCodeDist {
-		r.printf("  [%d]\t%d responses\n", code, num)
+		if r.grpc {
+			r.printf("  [%s]\t%d responses\n", grpcCodeName(code), num)
+		} else {
+			r.printf("  [%d]\t%d responses\n", code, num)
+		}
+	}
+}
+
+// printH2Conns prints stream counts and errors of each HTTP/2 connection.
+func (r *report) printH2Conns() {
+	r.printf("\nHTTP/2 connections:\n")
+	for _, c := range r.h2Conns {
+		r.printf("  [%d]\t%d streams, %d max concurrent, %d dials, %d GOAWAY, %d RST_STREAM\n",
+			c.idx, atomic.LoadInt64(&c.requests), atomic.LoadInt64(&c.maxActive),
+			atomic.LoadInt64(&c.dials), atomic.LoadInt64(&c.goAways), atomic.LoadInt64(&c.rstStreams))
+	}
+}
+
+// printWebSocket prints connection and message counts of a WebSocket run.
+func (r *report) printWebSocket() {
+	ws := r.ws
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	r.printf("\nWebSocket:\n")
+	r.printf("  Connects:\t%d\n", ws.connects)
+	r.printf("  Disconnects:\t%d\n", ws.disconnects)
+	r.printf("  Messages sent:\t%d\n", ws.sent)
+	r.printf("  Messages received:\t%d\n", ws.received)
+	r.printf("  Messages/sec:\t%4.4f\n", float64(ws.received)/r.timeUsed.Seconds())
+	if len(ws.connLats) > 0 {
+		r.printSection("Connect", mean(ws.connLats), ws.connLats)
+	}
+}
+
+// printAgents prints the outcome of a distributed test on each agent.
+func (r *report) printAgents() {
+	r.printf("\nAgents:\n")
+	for _, a := range r.agents {
+		if a.err != nil {
+			r.printf("  [%s]\tfailed: %v\n", a.addr, a.err)
+		} else {
+			r.printf("  [%s]\t%d responses\n", a.addr, a.requests)
+		}
+	}
+}
+
+// printSinks prints how many results reached each sink.
+func (r *report) printSinks() {
+	r.printf("\nSinks:\n")
+	for _, s := range r.sinkStats {
+		r.printf("  [%s]\t%d written, %d dropped, %d failed\n", s.Name, s.Written, s.Dropped, s.Failed)
 	}
 }
 
@@ -243,5 +496,7 @@ func (r *report) printErrors() {
 }
 
 func (r *report) printf(s string, v ...interface{}) {
-	fmt.Fprintf(r.w, s, v...)
+	if _, err := fmt.Fprintf(r.w, s, v...); err != nil && r.err == nil {
+		r.err = err
+	}
 }
@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"io"
+	"time"
+)
+
+// Report summarizes a load test.
+type Report struct {
+	// Total is the wall time of the test.
+	Total time.Duration
+
+	// Interrupted is set if the test was cancelled before all requests
+	// were sent.
+	Interrupted bool
+
+	// Requests is the number of responses received. Failed requests are
+	// counted in Errors instead.
+	Requests int
+
+	Fastest time.Duration
+	Slowest time.Duration
+	Average time.Duration
+	RPS     float64
+
+	// TargetRPS is the Work's QPS and SentRPS the rate requests were
+	// actually sent at, failed ones included. Both are zero unless the
+	// Work has a QPS.
+	TargetRPS float64
+	SentRPS   float64
+
+	// SizeTotal is the sum of the response sizes in bytes.
+	SizeTotal int64
+
+	// StatusCodes maps status codes to the number of responses with that
+	// code. For gRPC these are the numeric gRPC status codes.
+	StatusCodes map[int]int
+
+	// Errors maps error messages to the number of requests that failed
+	// with that error.
+	Errors map[string]int
+
+	// Groups breaks the results down per RequestGroup. It is empty
+	// unless the Work has Groups.
+	Groups []GroupReport
+
+	// Phases holds the timings of the http-trace phases. It is empty for
+	// gRPC.
+	Phases []Phase
+
+	// Latencies holds the response times at the 10th, 25th, 50th, 75th,
+	// 90th, 95th and 99th percentiles.
+	Latencies []Percentile
+
+	// Histogram holds the response time distribution in ten buckets.
+	Histogram []Bucket
+
+	// Retries tells how retries added to the load. It is nil unless the
+	// Work has a RetryPolicy.
+	Retries *RetryStats
+
+	// Hedges tells how often duplicates were sent and won. It is nil
+	// unless the Work hedges requests.
+	Hedges *HedgeStats
+
+	// Think tells how the time of the workers was split between service
+	// and think time. It is nil unless the Work has Think or Pacing.
+	Think *ThinkStats
+
+	// Token tells how the OAuth2 token endpoint was used. It is nil unless
+	// the Work has OAuth2.
+	Token *TokenStats
+
+	// Sinks tells how many results reached each of the Work's Sinks.
+	Sinks []SinkStats
+
+	r *report
+}
+
+// Phase is the timing of one http-trace phase, such as DNS-lookup, over all
+// requests.
+type Phase struct {
+	Name    string
+	Average time.Duration
+	Fastest time.Duration
+	Slowest time.Duration
+}
+
+// Percentile is the response time that P percent of the requests beat.
+type Percentile struct {
+	P       int
+	Latency time.Duration
+}
+
+// Bucket counts the responses slower than the previous bucket's Mark and
+// at most as slow as its own.
+type Bucket struct {
+	Mark  time.Duration
+	Count int
+}
+
+// A Renderer presents a finished report.
+type Renderer interface {
+	Render(rep *Report) error
+}
+
+// TextRenderer prints the report the way meg_sender does: a summary, or the
+// phase timings of every response as CSV.
+type TextRenderer struct {
+	W   io.Writer
+	CSV bool
+}
+
+func (t *TextRenderer) Render(rep *Report) error {
+	r := rep.r
+	r.w, r.err = t.W, nil
+	if t.CSV {
+		r.printCSV()
+	} else {
+		r.finalize()
+	}
+	return r.err
+}
+
+// MultiRenderer renders the report with each of its renderers in turn and
+// stops at the first error.
+type MultiRenderer []Renderer
+
+func (m MultiRenderer) Render(rep *Report) error {
+	for _, r := range m {
+		if err := r.Render(rep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summary returns the report of a calculated r.
+func (r *report) summary() *Report {
+	rep := &Report{
+		Total:       r.timeUsed,
+		Interrupted: r.interrupted,
+		Retries:     r.retries,
+		Hedges:      r.hedges,
+		Think:       r.think,
+		Groups:      r.groupReports(),
+		Token:       r.token,
+		Sinks:       r.sinkStats,
+		Requests:    len(r.lats),
+		SizeTotal:   r.sizeTotal,
+		StatusCodes: r.statusCodeDist,
+		Errors:      r.errorDist,
+		r:           r,
+	}
+	if len(r.lats) == 0 {
+		return rep
+	}
+	rep.Fastest = seconds(r.fastest)
+	rep.Slowest = seconds(r.slowest)
+	rep.Average = seconds(r.average)
+	rep.RPS = r.rps
+	rep.TargetRPS, rep.SentRPS = r.sendRate()
+	if !r.grpc {
+		for _, p := range r.phases() {
+			fastest, slowest := minMax(p.lats)
+			rep.Phases = append(rep.Phases, Phase{
+				Name:    p.name,
+				Average: seconds(p.avg),
+				Fastest: seconds(fastest),
+				Slowest: seconds(slowest),
+			})
+		}
+	}
+	pctls := []int{10, 25, 50, 75, 90, 95, 99}
+	for i, lat := range percentiles(r.sorted, pctls) {
+		rep.Latencies = append(rep.Latencies, Percentile{P: pctls[i], Latency: seconds(lat)})
+	}
+	buckets, counts := r.histogram()
+	for i := range buckets {
+		rep.Histogram = append(rep.Histogram, Bucket{Mark: seconds(buckets[i]), Count: counts[i]})
+	}
+	return rep
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
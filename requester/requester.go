@@ -17,10 +17,14 @@ package requester
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
@@ -29,29 +33,59 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/mohae/deepcopy"
 	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const megSenderUA = "meg/0.0.1"
 
-type result struct {
-	err           error
-	statusCode    int
-	duration      time.Duration
-	connDuration  time.Duration // connection setup(DNS lookup + Dial up) duration
-	dnsDuration   time.Duration // dns lookup duration
-	reqDuration   time.Duration // request "write" duration
-	resDuration   time.Duration // response "read" duration
-	delayDuration time.Duration // delay between response and request
-	contentLength int64
+// maxResult bounds the buffer of results waiting to be aggregated.
+const maxResult = 1000000
+
+// Result is the outcome of a single request. Err is set if the request
+// failed before a response was received; the other fields are then zero.
+type Result struct {
+	Start         time.Time // when the request was sent
+	Err           error
+	StatusCode    int
+	Duration      time.Duration
+	ConnDuration  time.Duration // connection setup(DNS lookup + Dial up) duration
+	DNSDuration   time.Duration // dns lookup duration
+	TLSDuration   time.Duration // TLS (or QUIC) handshake duration
+	ReqDuration   time.Duration // request "write" duration
+	ResDuration   time.Duration // response "read" duration
+	DelayDuration time.Duration // delay between response and request
+	ContentLength int64
+	Tag           string // value of TagField in the input row
+	Group         string // name of the RequestGroup the request belongs to
+
+	// Attempts is the number of attempts made under the Work's
+	// RetryPolicy. All other fields describe the last one, except Elapsed.
+	Attempts int
+
+	// Elapsed is the time from the start of the first attempt to the end
+	// of the last one, the waits between them included. It is only set
+	// under a RetryPolicy.
+	Elapsed time.Duration
+
+	// GaveUp is set if the last attempt still failed in a retryable way.
+	GaveUp bool
+
+	// Hedged is set if a duplicate of the request was sent, and HedgeWon
+	// if the duplicate completed first.
+	Hedged   bool
+	HedgeWon bool
+
+	stream   *streamResult     // per-event timings if Stream is set
+	captured *CapturedResponse // the exchange to capture, if Capture may want it
 }
 
 type Work struct {
 	// Request is the request to be made.
-	Request *http.Request
+	Request *http.Request `json:"-"`
 
 	//RequestBody []byte
 
@@ -70,13 +104,90 @@ type Work struct {
 	// H2 is an option to make HTTP/2 requests
 	H2 bool
 
+	// H2C makes HTTP/2 requests over cleartext TCP with prior knowledge.
+	// It only applies when H2Conns is set.
+	H2C bool
+
+	// H2Conns is the number of HTTP/2 connections shared by all workers.
+	// If zero, every worker uses its own transport.
+	H2Conns int
+
+	// H2StreamsPerConn is the maximum number of concurrent streams on each
+	// of the H2Conns connections. If zero, the server's limit applies.
+	H2StreamsPerConn int
+
+	// H3 is an option to make HTTP/3 requests over QUIC.
+	H3 bool
+
+	// H3ZeroRTT sends GET and HEAD requests in 0-RTT early data when an
+	// HTTP/3 session can be resumed.
+	H3ZeroRTT bool
+
+	// WSIDField is the JSON field that correlates a WebSocket message with
+	// its reply. If empty, the next message received is taken as the reply.
+	WSIDField string
+
+	// Stream measures responses event by event: time to first event, gaps
+	// between events and events per response.
+	Stream bool
+
+	// StreamDelimiter separates the events of a streamed response. If
+	// empty, DefaultStreamDelimiter is used.
+	StreamDelimiter string
+
+	// MaxStreamDuration cuts off streamed responses that last longer.
+	// Zero means no limit.
+	MaxStreamDuration time.Duration
+
+	// GRPC makes unary gRPC calls instead of HTTP requests. The input rows
+	// are the request messages in JSON and the request headers are sent as
+	// metadata.
+	GRPC bool
+
+	// GRPCCall is the method to call, as pkg.Service/Method.
+	GRPCCall string
+
+	// GRPCProto is the .proto file declaring GRPCCall. If empty, the
+	// method is looked up through the server reflection service.
+	GRPCProto string
+
+	// GracePeriod is how long in-flight requests may still complete once
+	// the context passed to Run is cancelled. Zero aborts them at once.
+	GracePeriod time.Duration
+
 	// Timeout in seconds.
 	SingleRequestTimeout time.Duration
+
+	// DialTimeout, TLSTimeout, FirstByteTimeout and BodyTimeout limit the
+	// phases of an HTTP request: getting a connection, the TLS handshake,
+	// waiting for the response once the request is written, and reading
+	// the response body. A request that overruns one fails with a
+	// *TimeoutError naming the phase. Zero means no limit.
+	DialTimeout      time.Duration
+	TLSTimeout       time.Duration
+	FirstByteTimeout time.Duration
+	BodyTimeout      time.Duration
+
+	// Hedge sends a duplicate of an HTTP request that has not completed
+	// within HedgeDelay and takes whichever completes first. If HedgeDelay
+	// is zero, the 95th percentile of the recent response times is used
+	// once enough responses are in.
+	Hedge      bool
+	HedgeDelay time.Duration
+
 	// Timeout in seconds
 	PerformanceTimeout time.Duration
 
-	// Qps is the rate limit.
-	QPS int
+	// QPS is the rate limit of all workers together, in requests per
+	// second. It may be fractional, e.g. 0.5 for one request every two
+	// seconds. Zero means no limit.
+	QPS float64
+
+	// Burst is how many requests may be sent at once when the workers
+	// fall behind the QPS rate, e.g. after slow responses or late timers.
+	// If zero, it is one: requests are evenly spaced and the time lost
+	// falling behind is not made up.
+	Burst int
 
 	// DisableCompression is an option to disable compression in response
 	DisableCompression bool
@@ -87,40 +198,127 @@ type Work struct {
 	// DisableRedirects is an option to prevent the following of HTTP redirects
 	DisableRedirects bool
 
+	// CookieJar gives every worker a cookie jar of its own, which keeps the
+	// cookies set by responses across the worker's iterations like a
+	// browser session. The jar's cookies are sent after those of a Cookie
+	// header in Request, which is sent on every request as is.
+	CookieJar bool
+
+	// Cookies are the cookies every jar starts with. They imply CookieJar.
+	Cookies []JarCookie
+
+	// ResetCookies empties the jar before every iteration, back to
+	// Cookies, so that each iteration is a new session.
+	ResetCookies bool
+
 	// RandomInput is an option to enable random data for input when input file has multi rows
 	RandomInput bool
 
+	// Groups, if set, mixes several kinds of requests. The groups take
+	// turns in proportion to their weights and the report is broken down
+	// per group as well.
+	Groups []*RequestGroup
+
+	// Once sends every input row exactly once and stops when the input is
+	// exhausted. N and RandomInput are ignored.
+	Once bool
+
 	// send requests synchronous in single worker
 	Async bool
 
-	// Output represents the output type. If "csv" is provided, the
-	// output will be dumped as a csv stream.
-	Output string
+	// Think, if set, makes every worker pause between iterations like a
+	// user would.
+	Think *ThinkTime
+
+	// Pacing makes every iteration of a worker take this long, by pausing
+	// for whatever the request left of it. It cannot be combined with
+	// Think.
+	Pacing time.Duration
 
 	// ProxyAddr is the address of HTTP proxy server in the format on "host:port".
 	// Optional.
 	ProxyAddr *url.URL
 
-	// Writer is where results will be written. If nil, results are written to stdout.
-	Writer io.Writer
+	// OnResult is called with every result as it comes in. Calls are made
+	// one at a time from a single goroutine.
+	OnResult func(Result) `json:"-"`
+
+	// Renderer presents the report once the test is over. If nil, nothing
+	// is printed.
+	Renderer Renderer `json:"-"`
+
+	// Metrics, if set, is updated while the test runs.
+	Metrics *Metrics `json:"-"`
+
+	// Sinks receive all results as they come in.
+	Sinks []Sink `json:"-"`
+
+	// Capture, if set, saves a sample of the responses instead of printing
+	// them.
+	Capture *Capture `json:"-"`
+
+	// Retry, if set, retries failed HTTP requests.
+	Retry *RetryPolicy
+
+	// OAuth2, if set, sends every HTTP request with a bearer token from an
+	// OAuth2 token endpoint, before the Signer signs it.
+	OAuth2 *OAuth2Config
+
+	// Signer, if set, signs every HTTP request before it is sent.
+	Signer Signer `json:"-"`
+
+	// TestName labels the metrics of the test.
+	TestName string
+
+	// TagField is the JSON field of the input rows whose value tags the
+	// results and labels the metrics of each row. Every distinct value is
+	// a separate time series, so it should have few values.
+	TagField string
 
-	results   chan *result
-	stopCh    chan struct{}
+	seq       int64 // sequence number of the next request, shared by all workers
+	limit     int64 // number of requests to send
+	completed int64
+
+	ctx       context.Context // cancelled to stop sending
+	reqCtx    context.Context // cancelled to abort in-flight requests
+	results   chan *Result
 	startTime time.Time
 
-	report *report
-}
+	h2Conns    []*h2Conn
+	h3Sessions tls.ClientSessionCache
 
-func (b *Work) writer() io.Writer {
-	if b.Writer == nil {
-		return os.Stdout
-	}
-	return b.Writer
+	grpcMethod     protoreflect.MethodDescriptor
+	grpcFullMethod string
+
+	hedgeLats  *latencyWindow
+	groupOrder []int // indexes into Groups, one cycle of their turns
+	thinks     *thinkCounter
+	tokens     *tokenSource
+	limiter    *limiter // shared by all workers if QPS is set
+
+	report *report
 }
 
-// Run makes all the requests, prints the summary. It blocks until
-// all work is done.
-func (b *Work) Run() {
+// Run makes all the requests and returns the report, rendered by Renderer
+// if one is set. It blocks until all work is done. Once ctx is cancelled no
+// more requests are sent, in-flight ones get GracePeriod to complete and the
+// report covers the requests completed so far.
+func (b *Work) Run(ctx context.Context) (*Report, error) {
+	reqCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+	b.ctx, b.reqCtx = ctx, reqCtx
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-reqCtx.Done():
+			return
+		}
+		select {
+		case <-time.After(b.GracePeriod):
+		case <-reqCtx.Done():
+		}
+		abort()
+	}()
 	// append hey's user agent
 	ua := b.Request.UserAgent()
 	if ua == "" {
@@ -129,122 +327,406 @@ func (b *Work) Run() {
 		ua += " " + megSenderUA
 	}
 
-	b.results = make(chan *result)
-	b.stopCh = make(chan struct{}, b.C)
+	if b.Retry != nil {
+		if err := b.Retry.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.validatePause(); err != nil {
+		return nil, err
+	}
+	if err := b.prepareGroups(); err != nil {
+		return nil, err
+	}
+	if (b.OAuth2 != nil || b.Signer != nil) && (b.GRPC || b.isWebSocket()) {
+		return nil, errors.New("OAuth2 and Signer only apply to HTTP requests")
+	}
+	if b.GRPC {
+		md, err := b.resolveGRPCMethod()
+		if err != nil {
+			return nil, err
+		}
+		b.grpcMethod = md
+		b.grpcFullMethod = fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name())
+	}
+	// The token is fetched last, as nothing stops its refreshing if Run
+	// fails before the workers start.
+	b.tokens = nil
+	if b.OAuth2 != nil {
+		if err := b.startOAuth2(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case b.Once:
+		b.limit = int64(b.rows())
+	case b.PerformanceTimeout > 0:
+		b.limit = math.MaxInt64
+	default:
+		b.limit = int64(b.N)
+	}
+	b.seq, b.completed = 0, 0
+	b.limiter = nil
+	if b.QPS > 0 {
+		b.limiter = newLimiter(b.QPS, b.Burst)
+	}
+	b.results = make(chan *Result, min(b.C*1000, maxResult))
 	b.startTime = time.Now()
-	b.report = newReport(b.writer(), b.results, b.Output)
+	b.report = newReport(b.results, b.OnResult)
+	b.report.work = b
+	for _, sink := range b.Sinks {
+		b.report.sinks = append(b.report.sinks, startSink(sink))
+	}
+	if b.H2Conns > 0 {
+		b.h2Conns = b.newH2Conns()
+		b.report.h2Conns = b.h2Conns
+	}
+	if b.H3ZeroRTT {
+		b.h3Sessions = tls.NewLRUClientSessionCache(b.C)
+	}
+	if b.isWebSocket() {
+		b.report.ws = &wsStats{}
+	}
+	b.report.grpc = b.GRPC
+	if b.Retry != nil {
+		b.report.retries = &RetryStats{}
+	}
+	if b.Hedge {
+		b.hedgeLats = &latencyWindow{}
+		b.report.hedges = &HedgeStats{}
+	}
+	b.thinks = &thinkCounter{}
+	Debug.Printf("sending %d requests to %s with %d workers\n", b.limit, b.Request.URL, b.C)
 	b.report.start()
+	b.Metrics.watch(reqCtx, b.TestName, b.QPS, &b.completed)
 
 	b.runWorkers()
-	b.Finish()
+	b.closeH2Conns()
+	if b.tokens != nil {
+		b.report.token = b.tokens.close()
+	}
+	if err := b.Capture.flush(); err != nil {
+		Error.Printf("capture: %v\n", err)
+	}
+	// All workers are done, so nothing sends on results any more.
+	close(b.results)
+	b.report.stop()
+	if b.pausing() {
+		b.report.think = b.thinks.stats()
+		b.report.think.Pacing = b.Pacing
+	}
+
+	b.report.interrupted = ctx.Err() != nil
+	rep := b.report.summary()
+	if b.Renderer != nil {
+		if err := b.Renderer.Render(rep); err != nil {
+			return rep, err
+		}
+	}
+	return rep, nil
 }
 
-func (b *Work) Finish() {
-	for i := 0; i < b.C; i++ {
-		b.stopCh <- struct{}{}
+// context returns the context requests are made with.
+func (b *Work) context() context.Context {
+	if b.reqCtx == nil {
+		return context.Background()
 	}
-	close(b.results)
-	b.results = nil
+	return b.reqCtx
+}
 
-	b.report.stop()
+// done returns a channel that is closed once no more requests are to be
+// sent.
+func (b *Work) done() <-chan struct{} {
+	if b.ctx == nil {
+		return nil
+	}
+	return b.ctx.Done()
 }
 
+// stopped reports whether the test has been cancelled.
+func (b *Work) stopped() bool {
+	return b.ctx != nil && b.ctx.Err() != nil
+}
+
+// makeRequest sends the request for input row p, retrying it as the Retry
+// policy says, and reports the outcome.
 func (b *Work) makeRequest(c *http.Client, p *RequestParam) {
+	defer b.Metrics.request(b.TestName)()
+	s := time.Now()
+	for attempt := 1; ; attempt++ {
+		var res *Result
+		var after time.Duration
+		if b.Hedge {
+			res, after = b.hedgedAttempt(c, p)
+		} else {
+			res, after = b.attempt(b.context(), c, p)
+		}
+		if b.Retry == nil {
+			b.sendResult(p, res)
+			return
+		}
+		res.Attempts = attempt
+		res.Elapsed = res.Start.Add(res.Duration).Sub(s)
+		if !b.Retry.retryable(res) {
+			b.sendResult(p, res)
+			return
+		}
+		wait := b.Retry.wait(attempt)
+		if after > 0 {
+			wait = min(after, b.Retry.maxRetryAfter())
+		}
+		if attempt > b.Retry.Max || b.stopped() {
+			res.GaveUp = true
+			b.sendResult(p, res)
+			return
+		}
+		Debug.Printf("retry %d of %s in %v\n", attempt, b.Request.URL, wait)
+		select {
+		case <-time.After(wait):
+		case <-b.done():
+			res.GaveUp = true
+			b.sendResult(p, res)
+			return
+		}
+	}
+}
+
+// attempt sends the request for input row p once, with ctx. It returns the
+// result and the wait asked for by a Retry-After header.
+func (b *Work) attempt(ctx context.Context, c *http.Client, p *RequestParam) (*Result, time.Duration) {
 	s := time.Now()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	pt := &phaseTimer{cancel: cancel}
+	defer pt.stop()
 	var size int64
 	var code int
-	var dnsStart, connStart, resStart, reqStart, delayStart time.Time
-	var dnsDuration, connDuration, resDuration, reqDuration, delayDuration time.Duration
+	var dnsStart, connStart, tlsStart, resStart, reqStart, delayStart time.Time
+	var dnsDuration, connDuration, tlsDuration, reqDuration, delayDuration time.Duration
 	//req := cloneRequest(b.Request, b.RequestBody)
-	req := cloneRequest(b.Request, p, b.DataType)
+	tmpl, dataType := b.template(p)
+	req := cloneRequest(tmpl, p, dataType)
+	if b.tokens != nil {
+		req.Header.Set("Authorization", "Bearer "+b.tokens.current())
+	}
+	if b.Signer != nil {
+		if err := b.sign(req); err != nil {
+			Error.Println(err)
+			return &Result{Start: s, Err: err}, 0
+		}
+	}
+	// HTTP/2 calls some of the hooks from its own goroutines.
+	var mu sync.Mutex
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			dnsStart = time.Now()
 		},
 		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			dnsDuration = time.Now().Sub(dnsStart)
 		},
 		GetConn: func(h string) {
+			mu.Lock()
+			defer mu.Unlock()
 			connStart = time.Now()
+			pt.arm(b.DialTimeout, "dial")
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+			pt.arm(b.TLSTimeout, "TLS handshake")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsDuration = time.Now().Sub(tlsStart)
 		},
 		GotConn: func(connInfo httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			connDuration = time.Now().Sub(connStart)
 			reqStart = time.Now()
+			pt.stop()
 		},
 		WroteRequest: func(w httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			reqDuration = time.Now().Sub(reqStart)
 			delayStart = time.Now()
+			pt.arm(b.FirstByteTimeout, "first byte")
 		},
 		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
 			delayDuration = time.Now().Sub(delayStart)
 			resStart = time.Now()
+			pt.stop()
 		},
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
 	resp, err := c.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
+		pt.arm(b.BodyTimeout, "body")
 	}
-	if err == nil {
+	var st *streamResult
+	var body *bytes.Buffer // the response body, if read
+	if err == nil && b.Stream {
+		code = resp.StatusCode
+		st, err = b.readStream(resp, s, p.Content)
+		if err == nil {
+			size = st.size
+			body = &st.body
+		}
+	} else if err == nil {
 		size = resp.ContentLength
 		code = resp.StatusCode
-		body := &bytes.Buffer{}
-		if b.DisableOutput == false {
-			_, err := body.ReadFrom(resp.Body)
+		if b.Capture.want(code/100 == 2, nil) {
+			body = &bytes.Buffer{}
+			_, err = body.ReadFrom(io.LimitReader(resp.Body, int64(b.Capture.maxBody())+1))
+		} else if b.printResponses() {
+			body = &bytes.Buffer{}
+			_, err = body.ReadFrom(resp.Body)
 			if err == nil {
 				Info.Printf("%s\t%d\t%s\n", strings.TrimSpace(string(p.Content)), code, strings.TrimSpace(body.String()))
-			} else {
-				Error.Println(err)
-				return
 			}
 		}
-		io.Copy(ioutil.Discard, resp.Body)
-	} else {
+		if _, cerr := io.Copy(ioutil.Discard, resp.Body); err == nil {
+			err = cerr
+		}
+	}
+	pt.stop()
+	if err != nil {
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, errHedgeLost):
+			return &Result{Start: s, Err: cause}, 0
+		case errors.As(cause, new(*TimeoutError)):
+			err = cause
+		}
 		Error.Println(err)
-		return
+		res := &Result{Start: s, Err: err}
+		if b.Capture.want(false, err) {
+			res.captured = &CapturedResponse{
+				Time:          s,
+				Input:         string(p.Content),
+				Method:        req.Method,
+				URL:           req.URL.String(),
+				RequestHeader: req.Header,
+				Error:         err.Error(),
+				Duration:      time.Now().Sub(s).Seconds(),
+			}
+		}
+		return res, 0
 	}
 	t := time.Now()
-	resDuration = t.Sub(resStart)
-	finish := t.Sub(s)
-
-	select {
-	case b.results <- &result{
-		statusCode:    code,
-		duration:      finish,
-		err:           err,
-		contentLength: size,
-		connDuration:  connDuration,
-		dnsDuration:   dnsDuration,
-		reqDuration:   reqDuration,
-		resDuration:   resDuration,
-		delayDuration: delayDuration,
-	}:
-	default:
+	mu.Lock()
+	res := &Result{
+		Start:         s,
+		StatusCode:    code,
+		Duration:      t.Sub(s),
+		ContentLength: size,
+		ConnDuration:  connDuration,
+		DNSDuration:   dnsDuration,
+		TLSDuration:   tlsDuration,
+		ReqDuration:   reqDuration,
+		ResDuration:   t.Sub(resStart),
+		DelayDuration: delayDuration,
+		stream:        st,
 	}
+	mu.Unlock()
+	if body != nil && b.Capture.want(code/100 == 2, nil) {
+		res.captured = &CapturedResponse{
+			Time:          s,
+			Input:         string(p.Content),
+			Method:        req.Method,
+			URL:           req.URL.String(),
+			RequestHeader: req.Header,
+			Status:        code,
+			Header:        resp.Header,
+			Duration:      res.Duration.Seconds(),
+			Body:          body.String(),
+		}
+	}
+	return res, retryAfter(resp)
 }
 
-// @param n	count to send
-func (b *Work) runWorker(n int, widx int) {
-	var throttle <-chan time.Time
-	if b.QPS > 0 {
-		throttle = time.Tick(time.Duration((1e6/(b.QPS))*b.C) * time.Microsecond)
+// sendResult hands the result of input row p over to the capture, the
+// metrics and the report. It blocks if the report falls behind, rather
+// than losing the result. Only the final result of a request is sent, so
+// retried and hedged requests are captured once.
+func (b *Work) sendResult(p *RequestParam, res *Result) {
+	if res.captured != nil && b.Capture.want(res.Err == nil && res.StatusCode/100 == 2, res.Err) {
+		b.Capture.add(res.captured)
 	}
+	if p.group != nil {
+		res.Group = p.group.Name
+		res.Tag = p.group.Name
+	}
+	if b.TagField != "" {
+		res.Tag = rowTag(p.Content, b.TagField)
+	}
+	atomic.AddInt64(&b.completed, 1)
+	b.Metrics.observe(b.TestName, res)
+	b.results <- res
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-		DisableCompression: b.DisableCompression,
-		DisableKeepAlives:  b.DisableKeepAlives,
-		Proxy:              http.ProxyURL(b.ProxyAddr),
+// rowTag returns the value of field in the JSON input row, without quotes
+// if it is a string.
+func rowTag(row []byte, field string) string {
+	v := jsonField(row, field)
+	var str string
+	if err := json.Unmarshal(v, &str); err == nil {
+		return str
+	}
+	return string(v)
+}
+
+// runWorker sends requests until there are none left. widx spreads the
+// workers over the shared HTTP/2 connections.
+func (b *Work) runWorker(widx int) {
+	defer b.Metrics.worker(b.TestName)()
+	if b.isWebSocket() {
+		b.runWSWorker()
+		return
+	}
+	if b.GRPC {
+		b.runGRPCWorker()
+		return
 	}
-	if b.H2 {
-		http2.ConfigureTransport(tr)
+
+	var tr http.RoundTripper
+	if b.H3 {
+		h3 := b.newH3Transport()
+		defer h3.Close()
+		tr = h3
+	} else if len(b.h2Conns) > 0 {
+		tr = b.h2Conns[widx%len(b.h2Conns)]
 	} else {
-		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		t := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DisableCompression: b.DisableCompression,
+			DisableKeepAlives:  b.DisableKeepAlives,
+			Proxy:              http.ProxyURL(b.ProxyAddr),
+		}
+		if b.H2 {
+			http2.ConfigureTransport(t)
+		} else {
+			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+		tr = t
 	}
 
 	client := &http.Client{Transport: tr, Timeout: b.SingleRequestTimeout}
+	if b.usesJar() {
+		client.Jar = b.newJar()
+	}
 	if b.DisableRedirects {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
@@ -252,116 +734,114 @@ func (b *Work) runWorker(n int, widx int) {
 	}
 
 	if b.Async {
-		// async
-		cli := deepcopy.Copy(*client)
-		cliObj, ok := cli.(http.Client)
-		if ok {
-			if b.PerformanceTimeout > 0 {
-				b.asyncSend(throttle, cliObj)
-			} else {
-				b.asyncSendN(widx, n, throttle, cliObj)
-			}
-		}
+		b.asyncSend(*client)
 	} else {
-		// sync
-		cli := deepcopy.Copy(*client)
-		cliObj, ok := cli.(http.Client)
-		if ok {
-			if b.PerformanceTimeout > 0 {
-				b.syncSend(throttle, cliObj)
-			} else {
-				b.syncSendN(widx, n, throttle, cliObj)
-			}
-		}
+		b.syncSend(*client)
 	}
 }
 
-// sync send n
-func (b *Work) syncSendN(widx int, n int, throttle <-chan time.Time, client http.Client) {
-	for i := 0; i < n; i++ {
-		if b.QPS > 0 {
-			<-throttle
+// runLoop calls send with the sequence number of every request the worker
+// takes, until there are none left. Between iterations it pauses for the
+// think time or pacing, before it takes the next request, so that a pause
+// holds neither a sequence number nor a rate limit token.
+func (b *Work) runLoop(send func(i int)) {
+	var service time.Duration
+	for iter := 0; ; iter++ {
+		if iter > 0 && b.pausing() {
+			if atomic.LoadInt64(&b.seq) >= b.limit || !b.pause(service) {
+				return
+			}
 		}
-		select {
-		case <-b.stopCh:
-			break
-		default:
-			requestParam := b.getRequestParam(i*b.C + widx)
-			b.makeRequest(&client, &requestParam)
+		i, ok := b.next()
+		if !ok {
+			return
+		}
+		s := time.Now()
+		send(i)
+		service = time.Now().Sub(s)
+		if b.pausing() {
+			b.thinks.add(func(s *ThinkStats) {
+				s.Iterations++
+				s.Service += service
+			})
 		}
 	}
 }
 
-// sync send
-func (b *Work) syncSend(throttle <-chan time.Time, client http.Client) {
-	for i := 0; ; i++ {
-		if time.Now().Sub(b.startTime) > b.PerformanceTimeout {
-			break
-		}
-		if b.QPS > 0 {
-			<-throttle
-		}
-		select {
-		case <-b.stopCh:
-			break
-		default:
-			requestParam := b.getRequestParam(i)
-			b.makeRequest(&client, &requestParam)
-		}
+// next waits for the rate limit and takes the sequence number of the next
+// request from the counter shared by all workers. It returns false once
+// all requests have been handed out, PerformanceTimeout has passed or the
+// test is cancelled.
+func (b *Work) next() (int, bool) {
+	if b.PerformanceTimeout > 0 && time.Now().Sub(b.startTime) > b.PerformanceTimeout {
+		return 0, false
 	}
+	if !b.wait() {
+		return 0, false
+	}
+	i := atomic.AddInt64(&b.seq, 1) - 1
+	if i >= b.limit {
+		return 0, false
+	}
+	return int(i), true
 }
 
-// async send by count
-func (b *Work) asyncSendN(widx int, n int, throttle <-chan time.Time, client http.Client) {
-	var wg sync.WaitGroup
-	wg.Add(n)
-	for i := 0; i < n; i++ {
-		if b.QPS > 0 {
-			<-throttle
-		}
-		go func() {
-			select {
-			case <-b.stopCh:
-				break
-			default:
-				requestParam := b.getRequestParam(i*b.C + widx)
-				b.makeRequest(&client, &requestParam)
-			}
-			wg.Done()
-		}()
+// wait blocks until the rate limit lets the next request through, if QPS
+// is set. It returns false once the test is cancelled.
+func (b *Work) wait() bool {
+	if b.limiter != nil && !b.limiter.wait(b.done()) {
+		return false
 	}
-	wg.Wait()
+	return !b.stopped()
 }
 
-// async send by time
-func (b *Work) asyncSend(throttle <-chan time.Time, client http.Client) {
-	var wg sync.WaitGroup
-	for i := 0; ; i++ {
-		if time.Now().Sub(b.startTime) > b.PerformanceTimeout {
-			break
+// syncSend makes one request at a time.
+func (b *Work) syncSend(client http.Client) {
+	b.runLoop(func(i int) {
+		if b.usesJar() && b.ResetCookies {
+			client.Jar = b.newJar()
 		}
+		requestParam := b.getRequestParam(i)
+		b.makeRequest(&client, &requestParam)
+	})
+}
+
+// asyncSend starts every request without waiting for the previous one.
+func (b *Work) asyncSend(client http.Client) {
+	var wg sync.WaitGroup
+	b.runLoop(func(i int) {
 		wg.Add(1)
-		if b.QPS > 0 {
-			<-throttle
+		c := &client
+		if b.usesJar() && b.ResetCookies {
+			// Requests overlap, so each gets a copy of the client.
+			session := client
+			session.Jar = b.newJar()
+			c = &session
 		}
 		go func() {
-			select {
-			case <-b.stopCh:
-				break
-			default:
-				requestParam := b.getRequestParam(i)
-				b.makeRequest(&client, &requestParam)
-			}
-			wg.Done()
+			defer wg.Done()
+			requestParam := b.getRequestParam(i)
+			b.makeRequest(c, &requestParam)
 		}()
-	}
+	})
 	wg.Wait()
 }
 
+// rows returns the number of input rows.
+func (b *Work) rows() int {
+	if b.RequestParamSlice == nil {
+		return 0
+	}
+	return len(b.RequestParamSlice.RequestParams)
+}
+
 func (b *Work) getRequestParam(idx int) RequestParam {
-	length := len(b.RequestParamSlice.RequestParams)
+	if len(b.Groups) > 0 {
+		return b.groupRequestParam(idx)
+	}
+	length := b.rows()
 	if length > 0 {
-		if b.RandomInput {
+		if b.RandomInput && !b.Once {
 			return b.RequestParamSlice.RequestParams[rand.Intn(length)]
 		} else {
 			return b.RequestParamSlice.RequestParams[(idx)%length]
@@ -379,7 +859,7 @@ func (b *Work) runWorkers() {
 
 	for i := 0; i < b.C; i++ {
 		go func(i int) {
-			b.runWorker(b.N/(b.C), i)
+			b.runWorker(i)
 			defer wg.Done()
 		}(i)
 	}
@@ -16,13 +16,54 @@ package requester
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 func TestN(t *testing.T) {
@@ -39,14 +80,13 @@ func TestN(t *testing.T) {
 		N:       20,
 		C:       2,
 	}
-	w.Run()
-	if count != 20 {
-		t.Errorf("Expected to boom 20 times, found %v", count)
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 20 {
+		t.Errorf("Expected to boom 20 times, found %v", atomic.LoadInt64(&count))
 	}
 }
 
 func TestQps(t *testing.T) {
-	var wg sync.WaitGroup
 	var count int64
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		atomic.AddInt64(&count, int64(1))
@@ -56,20 +96,117 @@ func TestQps(t *testing.T) {
 
 	req, _ := http.NewRequest("GET", server.URL, nil)
 	w := &Work{
-		Request: req,
-		N:       20,
-		C:       2,
-		QPS:     1,
+		Request:       req,
+		N:             20,
+		C:             2,
+		QPS:           1,
+		DisableOutput: true,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(900 * time.Millisecond)
+	if n := atomic.LoadInt64(&count); n > 1 {
+		t.Errorf("Expected to work 1 times, found %v", n)
+	}
+	cancel()
+	<-done
+}
+
+// fakeClock is a clock for the limiter that only moves when told.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := newLimiterAt(0.5, 0, clock.now)
+	if d := l.reserve(); d != 0 {
+		t.Errorf("Expected the first request to go at once, found a wait of %v", d)
+	}
+	if d := l.reserve(); d != 2*time.Second {
+		t.Errorf("Expected a wait of 2s at 0.5 QPS, found %v", d)
 	}
-	wg.Add(1)
-	time.AfterFunc(time.Second, func() {
-		if count > 1 {
-			t.Errorf("Expected to work 1 times, found %v", count)
+
+	l = newLimiterAt(10, 5, clock.now)
+	for i := 0; i < 5; i++ {
+		if d := l.reserve(); d > 0 {
+			t.Errorf("Expected request %d to use the burst, found a wait of %v", i+1, d)
 		}
-		wg.Done()
-	})
-	go w.Run()
-	wg.Wait()
+	}
+	if d := l.reserve(); d != 100*time.Millisecond {
+		t.Errorf("Expected a wait of 100ms after the burst, found %v", d)
+	}
+
+	// The workers taking the tokens in turn get exactly the rate, without
+	// rounding piling up over a second even if the interval is no whole
+	// number of nanoseconds.
+	for _, rate := range []float64{50000, 30000} {
+		start := time.Unix(0, 0)
+		clock.t = start
+		l = newLimiterAt(rate, 0, clock.now)
+		for i := 0; i <= int(rate); i++ {
+			clock.t = clock.t.Add(l.reserve())
+		}
+		if d := clock.t.Sub(start) - time.Second; d < -time.Nanosecond || d > time.Nanosecond {
+			t.Errorf("Expected request %v to go after 1s at %v QPS, found %v", rate+1, rate, clock.t.Sub(start))
+		}
+	}
+
+	// Time lost by a late worker is only made up within the burst.
+	clock.t = time.Unix(0, 0)
+	l = newLimiterAt(1000, 0, clock.now)
+	l.reserve()
+	clock.t = clock.t.Add(5 * time.Millisecond)
+	if d1, d2 := l.reserve(), l.reserve(); d1 != 0 || d2 != time.Millisecond {
+		t.Errorf("Expected a late worker to go at once and the next 1ms later, found %v and %v", d1, d2)
+	}
+	clock.t = time.Unix(0, 0)
+	l = newLimiterAt(1000, 10, clock.now)
+	for i := 0; i < 10; i++ {
+		l.reserve()
+	}
+	clock.t = clock.t.Add(5 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if d := l.reserve(); d > 0 {
+			t.Errorf("Expected late request %d to catch up, found a wait of %v", i+1, d)
+		}
+	}
+	if d := l.reserve(); d != time.Millisecond {
+		t.Errorf("Expected a wait of 1ms once caught up, found %v", d)
+	}
+}
+
+func TestTargetRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures the sending rate")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	run := func(n int, qps float64, burst int) *Report {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{Request: req, N: n, C: 50, QPS: qps, Burst: burst, DisableOutput: true}
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+
+	// Aim at 50k QPS for half a second with a 10ms burst, on a machine
+	// that manages twice that without a limit.
+	const target = 50000
+	if rps := run(5000, 0, 0).RPS; rps < 2*target {
+		t.Skipf("the machine sends %.0f requests/s, too few to measure %d/s", rps, target)
+	}
+	rep := run(target/2, target, target/100)
+	if rep.TargetRPS != target || rep.SentRPS < target*0.99 || rep.SentRPS > target*1.01 {
+		t.Errorf("Expected requests sent at %v/s, found %v", target, rep.SentRPS)
+	}
 }
 
 func TestRequest(t *testing.T) {
@@ -95,7 +232,10 @@ func TestRequest(t *testing.T) {
 		N:       1,
 		C:       1,
 	}
-	w.Run()
+	w.Run(context.Background())
+	if method != "GET" {
+		t.Errorf("Method is expected to be GET, %v is found", method)
+	}
 	if uri != "/" {
 		t.Errorf("Uri is expected to be /, %v is found", uri)
 	}
@@ -121,15 +261,2197 @@ func TestBody(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	defer server.Close()
 
-	req, _ := http.NewRequest("POST", server.URL, bytes.NewBuffer([]byte("Body")))
+	req, _ := http.NewRequest("POST", server.URL, nil)
 	w := &Work{
 		Request: req,
-		//RequestBody: []byte("Body"),
+		RequestParamSlice: &RequestParamSlice{
+			RequestParams: []RequestParam{{Content: []byte("Body")}},
+		},
 		N: 10,
 		C: 1,
 	}
-	w.Run()
-	if count != 10 {
-		t.Errorf("Expected to work 10 times, found %v", count)
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 10 {
+		t.Errorf("Expected to work 10 times, found %v", atomic.LoadInt64(&count))
+	}
+}
+
+func TestNNotDivisibleByC(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	for _, async := range []bool{false, true} {
+		atomic.StoreInt64(&count, 0)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{
+			Request:       req,
+			N:             10,
+			C:             3,
+			Async:         async,
+			DisableOutput: true,
+		}
+		w.Run(context.Background())
+		if got := atomic.LoadInt64(&count); got != 10 {
+			t.Errorf("Expected 10 requests with async %v, found %v", async, got)
+		}
+	}
+}
+
+func TestOnce(t *testing.T) {
+	var mu sync.Mutex
+	rows := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		rows[string(body)]++
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	params := &RequestParamSlice{}
+	for i := 0; i < 7; i++ {
+		params.RequestParams = append(params.RequestParams, RequestParam{Content: []byte{'a' + byte(i)}})
+	}
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	w := &Work{
+		Request:           req,
+		RequestParamSlice: params,
+		N:                 100,
+		C:                 3,
+		Once:              true,
+		DisableOutput:     true,
+	}
+	rep, _ := w.Run(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if len(rows) != 7 || rep.Requests != 7 {
+		t.Errorf("Expected 7 distinct rows, found %v in %d requests", rows, rep.Requests)
+	}
+	for row, num := range rows {
+		if num != 1 {
+			t.Errorf("Expected row %q to be sent once, found %d times", row, num)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var calls int
+	w := &Work{
+		Request:       req,
+		N:             10,
+		C:             1,
+		DisableOutput: true,
+		OnResult: func(res Result) {
+			calls++
+			if res.Err != nil || res.StatusCode != http.StatusOK || res.ContentLength != 5 {
+				t.Errorf("Expected a 200 response of 5 bytes, found %+v", res)
+			}
+		},
+	}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || rep.Requests == 0 {
+		t.Fatalf("Expected results, found %d callbacks and %d requests", calls, rep.Requests)
+	}
+	if rep.StatusCodes[http.StatusOK] != rep.Requests {
+		t.Errorf("Expected %d responses with status 200, found %v", rep.Requests, rep.StatusCodes)
+	}
+	if rep.Fastest > rep.Average || rep.Average > rep.Slowest {
+		t.Errorf("Expected fastest <= average <= slowest, found %v, %v, %v", rep.Fastest, rep.Average, rep.Slowest)
+	}
+	if len(rep.Latencies) != 7 || len(rep.Histogram) != 11 || len(rep.Phases) != 5 {
+		t.Errorf("Expected 7 percentiles, 11 buckets and 5 phases, found %+v", rep)
+	}
+}
+
+func TestHTMLRenderer(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	var text, page bytes.Buffer
+	w := &Work{
+		Request:       req,
+		N:             20,
+		C:             2,
+		DisableOutput: true,
+		Renderer:      MultiRenderer{&TextRenderer{W: &text}, &HTMLRenderer{W: &page}},
+	}
+	if _, err := w.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "Summary:") {
+		t.Errorf("Expected the text summary, found %q", text.String())
+	}
+	out := page.String()
+	for _, want := range []string{
+		"<svg", "Latency over time", "Requests per second over time", "Response time histogram",
+		"<td>" + server.URL + "</td>", "<th>C</th><td>2</td>", "<th>N</th><td>20</td>", "(hidden)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the HTML report to contain %q", want)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("Expected the Authorization header to be hidden")
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	r := &report{
+		timeUsed:  2 * time.Second,
+		lats:      []float64{0.1, 0.2, 0.3, 0.1},
+		starts:    []float64{0, 0.5, 0.9, 1.5},
+		codes:     []int{200, 200, 503, 200},
+		errStarts: []float64{1.2},
+	}
+	got := r.timeSeries(time.Second)
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 buckets, found %+v", got)
+	}
+	// The third request completes after 1.2s and counts in the second bucket.
+	if got[0].requests != 2 || got[1].requests != 2 || got[0].errors != 0 || got[1].errors != 1 {
+		t.Errorf("Expected 2 responses in each bucket and 1 error in the second, found %+v", got)
+	}
+	if got[1].classes[2] != 1 || got[1].classes[5] != 1 {
+		t.Errorf("Expected a 2xx and a 5xx response in the second bucket, found %+v", got[1])
+	}
+	if got[0].p50 != 0.1 || got[0].p99 != 0.2 || got[1].rps != 2 {
+		t.Errorf("Expected p50 0.1, p99 0.2 and 2 req/s, found %+v", got)
+	}
+}
+
+func TestTimeSeriesRenderer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var raw, csv, jsonl bytes.Buffer
+	w := &Work{
+		Request:       req,
+		N:             10,
+		C:             1,
+		DisableOutput: true,
+		Renderer: MultiRenderer{
+			&TextRenderer{W: &raw, CSV: true},
+			&TimeSeriesRenderer{W: &csv},
+			&TimeSeriesRenderer{W: &jsonl, Interval: time.Minute, JSON: true},
+		},
+	}
+	if _, err := w.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(raw.String()), "\n")
+	if len(lines) != 11 || !strings.HasSuffix(lines[0], ",offset,timestamp") {
+		t.Fatalf("Expected a header and 10 rows with timestamps, found %q", raw.String())
+	}
+	fields := strings.Split(lines[1], ",")
+	if _, err := time.Parse(time.RFC3339Nano, fields[len(fields)-1]); err != nil {
+		t.Errorf("Expected an RFC 3339 send time, found %v", err)
+	}
+	if !strings.HasPrefix(csv.String(), "timestamp,offset,requests,errors,1xx,2xx,") {
+		t.Errorf("Expected the time-series CSV header, found %q", csv.String())
+	}
+
+	var line timeSeriesLine
+	if err := json.Unmarshal(jsonl.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Requests != 10 || line.Status["2xx"] != 10 || line.P99 <= 0 || line.Timestamp.IsZero() {
+		t.Errorf("Expected a single bucket with 10 2xx responses, found %+v", line)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		n, _ := strconv.Atoi(string(body))
+		if n%3 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		// Rows 8 and 9 are the slowest by a wide margin, so that the
+		// order holds on a busy machine.
+		if n >= 8 {
+			time.Sleep(time.Duration(n-7) * 30 * time.Millisecond)
+		}
+		io.WriteString(w, strings.Repeat("x", 100))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	params := &RequestParamSlice{}
+	for i := 1; i <= 9; i++ {
+		params.RequestParams = append(params.RequestParams, RequestParam{Content: []byte(strconv.Itoa(i))})
+	}
+	run := func(c *Capture, retry *RetryPolicy) []CapturedResponse {
+		var buf bytes.Buffer
+		if c.Dir == "" {
+			c.W = &buf
+		}
+		req, _ := http.NewRequest("POST", server.URL, nil)
+		w := &Work{Request: req, RequestParamSlice: params, C: 1, Once: true, Capture: c, Retry: retry}
+		if _, err := w.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var got []CapturedResponse
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var r CapturedResponse
+			if err := dec.Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, r)
+		}
+		return got
+	}
+
+	got := run(&Capture{Non2xx: true, MaxBody: 10}, nil)
+	if len(got) != 3 {
+		t.Fatalf("Expected the 3 responses with status 500, found %+v", got)
+	}
+	for _, r := range got {
+		if r.Status != 500 || r.Body != "xxxxxxxxxx" || !r.Truncated || r.Method != "POST" || r.Header == nil {
+			t.Errorf("Expected a truncated 500 response, found %+v", r)
+		}
+	}
+	if got[0].Input != "3" {
+		t.Errorf("Expected the input row 3 first, found %q", got[0].Input)
+	}
+
+	// A body is not cut in the middle of a character.
+	var buf bytes.Buffer
+	c := &Capture{W: &buf, MaxBody: 4}
+	c.add(&CapturedResponse{Body: "aaaéé"})
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	var cut CapturedResponse
+	if err := json.Unmarshal(buf.Bytes(), &cut); err != nil || cut.Body != "aaa" || !cut.Truncated {
+		t.Errorf("Expected the body cut to %q, found %q, %v", "aaa", cut.Body, err)
+	}
+
+	// A retried request is captured once, with its last attempt.
+	got = run(&Capture{Non2xx: true}, &RetryPolicy{Max: 2, On: []string{"5xx"}})
+	if len(got) != 3 {
+		t.Errorf("Expected the 3 requests with status 500 once each, found %d records", len(got))
+	}
+
+	got = run(&Capture{Slowest: 2}, nil)
+	if len(got) != 2 || got[0].Input != "9" || got[1].Input != "8" {
+		t.Errorf("Expected the responses to rows 9 and 8, found %+v", got)
+	}
+	if got := run(&Capture{Every: 2, First: 3}, nil); len(got) != 2 || got[0].Input != "1" || got[1].Input != "3" {
+		t.Errorf("Expected the responses to rows 1 and 3, found %+v", got)
+	}
+
+	dir := t.TempDir()
+	run(&Capture{Dir: dir, First: 2}, nil)
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 || files[0].Name() != "000001-200.json" {
+		t.Errorf("Expected 2 files in the capture directory, found %v", files)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		attempts[string(body)]++
+		n := attempts[string(body)]
+		mu.Unlock()
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	run := func(max int) *Report {
+		mu.Lock()
+		attempts = make(map[string]int)
+		mu.Unlock()
+		params := &RequestParamSlice{}
+		for i := 0; i < 5; i++ {
+			params.RequestParams = append(params.RequestParams, RequestParam{Content: []byte{'a' + byte(i)}})
+		}
+		req, _ := http.NewRequest("POST", server.URL, nil)
+		w := &Work{
+			Request:           req,
+			RequestParamSlice: params,
+			C:                 2,
+			Once:              true,
+			DisableOutput:     true,
+			Retry:             &RetryPolicy{Max: max, On: []string{"5xx"}, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, Exponential: true},
+		}
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+
+	rep := run(3)
+	s := rep.Retries
+	if rep.StatusCodes[200] != 5 || s.Requests != 5 || s.FirstFailed != 5 || s.GaveUp != 0 || s.Attempts != 15 || s.ByRetries[2] != 5 {
+		t.Errorf("Expected 5 requests to succeed on the third attempt, found %v and %+v", rep.StatusCodes, s)
+	}
+	if a := s.Amplification(); a != 3 {
+		t.Errorf("Expected an amplification of 3, found %v", a)
+	}
+	rep = run(1)
+	if s := rep.Retries; rep.StatusCodes[503] != 5 || s.GaveUp != 5 || s.Attempts != 10 {
+		t.Errorf("Expected 5 requests to give up after 2 attempts, found %v and %+v", rep.StatusCodes, s)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, Retry: &RetryPolicy{On: []string{"4xx"}}}
+	if _, err := w.Run(context.Background()); err == nil {
+		t.Errorf("Expected an unknown retry condition to fail")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var n int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&n, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		N:             1,
+		C:             1,
+		DisableOutput: true,
+		Retry:         &RetryPolicy{Max: 1, On: []string{"429"}, Backoff: time.Millisecond},
+	}
+	rep, _ := w.Run(context.Background())
+	if rep.StatusCodes[200] != 1 || rep.Retries.SlowestElapsed < time.Second {
+		t.Errorf("Expected a response after waiting 1s, found %v after %v", rep.StatusCodes, rep.Retries.SlowestElapsed)
+	}
+	// The latency is that of the last attempt, without the wait.
+	if rep.Slowest >= time.Second {
+		t.Errorf("Expected the latency to leave out the wait, found %v", rep.Slowest)
+	}
+
+	// The wait is capped at MaxBackoff.
+	atomic.StoreInt64(&n, 0)
+	w.Retry.MaxBackoff = 50 * time.Millisecond
+	rep, _ = w.Run(context.Background())
+	if e := rep.Retries.SlowestElapsed; rep.StatusCodes[200] != 1 || e < 50*time.Millisecond || e >= time.Second {
+		t.Errorf("Expected a response after waiting 50ms, found %v after %v", rep.StatusCodes, e)
+	}
+}
+
+func TestThinkTime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	run := func(path string, think *ThinkTime, pacing time.Duration) *Report {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		w := &Work{Request: req, N: 4, C: 1, DisableOutput: true, Think: think, Pacing: pacing}
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+
+	rep := run("/", &ThinkTime{Dist: "constant", Min: 30 * time.Millisecond}, 0)
+	if s := rep.Think; s == nil || s.Iterations != 4 || s.Pauses != 3 || s.Think != 90*time.Millisecond {
+		t.Errorf("Expected 3 pauses of 30ms between 4 iterations, found %+v", s)
+	}
+	if rep.Total < 90*time.Millisecond {
+		t.Errorf("Expected the test to take at least the think time, found %v", rep.Total)
+	}
+
+	rep = run("/", nil, 50*time.Millisecond)
+	if s := rep.Think; s.Overruns != 0 || s.Pacing != 50*time.Millisecond || rep.Total < 150*time.Millisecond {
+		t.Errorf("Expected 4 iterations paced 50ms apart, found %+v in %v", s, rep.Total)
+	}
+	rep = run("/slow", nil, 10*time.Millisecond)
+	if s := rep.Think; s.Overruns != 3 || s.Think != 0 {
+		t.Errorf("Expected 3 iterations to overrun the pacing, found %+v", s)
+	}
+
+	dists := []ThinkTime{
+		{Dist: "uniform", Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+		{Dist: "normal", Mean: 15 * time.Millisecond, StdDev: 10 * time.Millisecond, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+		{Dist: "exponential", Mean: 15 * time.Millisecond, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+	}
+	for _, th := range dists {
+		for i := 0; i < 100; i++ {
+			if d := th.next(); d < th.Min || d > th.Max {
+				t.Fatalf("Expected %s think times within bounds, found %v", th.Dist, d)
+			}
+		}
+	}
+
+	// The rate limit token is taken after the pause, so the think time
+	// overlaps the wait for it.
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, N: 3, C: 1, QPS: 10, DisableOutput: true, Think: &ThinkTime{Dist: "constant", Min: 100 * time.Millisecond}}
+	if rep, _ := w.Run(context.Background()); rep.Total > 280*time.Millisecond {
+		t.Errorf("Expected 3 requests 100ms apart, found them to take %v", rep.Total)
+	}
+
+	for _, w := range []*Work{
+		{Request: req, N: 1, C: 1, Think: &ThinkTime{Dist: "poisson"}},
+		{Request: req, N: 1, C: 1, Think: &ThinkTime{Dist: "constant"}, Pacing: time.Second},
+		{Request: req, N: 1, C: 1, Pacing: time.Second, Async: true},
+		{Request: req, N: 1, C: 1, Think: &ThinkTime{Dist: "uniform", Min: 200 * time.Millisecond}},
+	} {
+		if _, err := w.Run(context.Background()); err == nil {
+			t.Errorf("Expected think time %+v with pacing %v to fail", w.Think, w.Pacing)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	bodies := make(map[string]bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		paths[r.Method+" "+r.URL.Path]++
+		bodies[string(body)] = true
+		mu.Unlock()
+		if r.URL.Path == "/compare" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/detect", nil)
+	w := &Work{
+		Request:       req,
+		N:             20,
+		C:             2,
+		DisableOutput: true,
+		Groups: []*RequestGroup{
+			{Name: "search", Weight: 70, Method: "POST", URL: server.URL + "/search", RequestParamSlice: &RequestParamSlice{
+				RequestParams: []RequestParam{{Content: []byte("q=a")}, {Content: []byte("q=b")}},
+			}},
+			{Name: "detect", Weight: 20},
+			{Name: "compare", Weight: 10, URL: server.URL + "/compare"},
+		},
+	}
+	var tags []string
+	w.OnResult = func(res Result) { tags = append(tags, res.Tag) }
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"POST /search": 14, "GET /detect": 4, "GET /compare": 2}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Expected requests by weight %v, found %v", want, paths)
+	}
+	if !bodies["q=a"] || !bodies["q=b"] {
+		t.Errorf("Expected the search group to send its own rows, found %v", bodies)
+	}
+	if len(rep.Groups) != 3 || rep.Groups[0].Name != "search" || rep.Groups[0].Requests != 14 || len(rep.Groups[0].Latencies) != 4 {
+		t.Fatalf("Expected a report for each group in order, found %+v", rep.Groups)
+	}
+	if g := rep.Groups[2]; g.Name != "compare" || g.StatusCodes[500] != 2 {
+		t.Errorf("Expected the compare group to have 2 errors, found %+v", g)
+	}
+	if len(tags) != 20 || tags[0] == "" {
+		t.Errorf("Expected the results to be tagged with their group, found %v", tags)
+	}
+
+	var out bytes.Buffer
+	if err := (&TextRenderer{W: &out}).Render(rep); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Request groups:") || !strings.Contains(out.String(), "search:\t14 responses") {
+		t.Errorf("Expected the summary to break down the groups, found %s", out.String())
+	}
+
+	w.Groups = []*RequestGroup{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}}
+	if _, err := w.Run(context.Background()); err == nil {
+		t.Errorf("Expected duplicate group names to fail")
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    []int
+	}{
+		{[]int{70, 20, 10}, []int{0, 0, 1, 0, 0, 2, 0, 0, 1, 0}},
+		{[]int{2, 4}, []int{1, 0, 1}},
+		{[]int{5}, []int{0}},
+	}
+	for _, tt := range tests {
+		if got := weightedOrder(tt.weights); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("weightedOrder(%v) = %v, want %v", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	var mu sync.Mutex
+	var headers []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Cookie"))
+		mu.Unlock()
+		if _, err := r.Cookie("session"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	run := func(w *Work) *Report {
+		req, _ := http.NewRequest("GET", server.URL+"/api", nil)
+		if w.Request != nil {
+			req.Header = w.Request.Header
+		}
+		w.Request, w.N, w.C, w.DisableOutput = req, 4, 1, true
+		mu.Lock()
+		headers = nil
+		mu.Unlock()
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+
+	if rep := run(&Work{}); rep.StatusCodes[401] != 4 {
+		t.Errorf("Expected every request without a jar to be refused, found %v", rep.StatusCodes)
+	}
+	if rep := run(&Work{CookieJar: true}); rep.StatusCodes[401] != 1 || rep.StatusCodes[200] != 3 {
+		t.Errorf("Expected the jar to keep the session after the first request, found %v", rep.StatusCodes)
+	}
+	if rep := run(&Work{CookieJar: true, ResetCookies: true}); rep.StatusCodes[401] != 4 {
+		t.Errorf("Expected every iteration to start a new session, found %v", rep.StatusCodes)
+	}
+
+	u, _ := url.Parse(server.URL)
+	file := "# Netscape HTTP Cookie File\n\n" +
+		u.Hostname() + "\tFALSE\t/\tFALSE\t0\tsession\tfromfile\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t4102444800\tother\tx\n"
+	cookies, err := LoadCookies(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 2 || cookies[1].Cookie.Domain != "example.com" || !cookies[1].Cookie.HttpOnly || !cookies[1].Cookie.Secure || cookies[1].URL != "https://example.com/" {
+		t.Fatalf("Cookie file was not parsed correctly, found %+v", cookies)
+	}
+	if rep := run(&Work{Cookies: cookies, ResetCookies: true}); rep.StatusCodes[200] != 4 {
+		t.Errorf("Expected the cookies of the file to be sent, found %v", rep.StatusCodes)
+	}
+	if headers[0] != "session=fromfile" {
+		t.Errorf("Expected only the cookie for the server's host, found %q", headers[0])
+	}
+
+	// A Cookie header is sent as is on every request, followed by the
+	// cookies of the jar.
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Cookie", "static=1")
+	run(&Work{Request: req, CookieJar: true})
+	if headers[0] != "static=1" || headers[1] != "static=1; session=s1" {
+		t.Errorf("Expected the Cookie header before the jar's cookies, found %q", headers)
+	}
+
+	if _, err := LoadCookies(strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Errorf("Expected a malformed cookie file to fail")
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	key := []byte("secret")
+	var failed int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, key)
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%x", r.Method, r.URL.Path, r.Header.Get("X-Timestamp"), sum)
+		if r.Header.Get("X-Sig") != hex.EncodeToString(mac.Sum(nil)) {
+			atomic.AddInt64(&failed, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/detect", nil)
+	w := &Work{
+		Request:           req,
+		RequestParamSlice: &RequestParamSlice{RequestParams: []RequestParam{{Content: []byte(`{"a":1}`)}, {Content: []byte(`{"a":2}`)}}},
+		N:                 4,
+		C:                 2,
+		DisableOutput:     true,
+		Signer: &HMACSigner{
+			Key:             key,
+			Canonical:       "{{.Method}}\n{{.Path}}\n{{.Header \"X-Timestamp\"}}\n{{.BodySHA256}}",
+			Header:          "X-Sig",
+			TimestampHeader: "X-Timestamp",
+		},
+	}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.StatusCodes[200] != 4 || failed != 0 {
+		t.Errorf("Expected 4 correctly signed requests, found %v", rep.StatusCodes)
+	}
+
+	w.Signer = &HMACSigner{Key: key, Canonical: "{{.Missing}}"}
+	if rep, _ := w.Run(context.Background()); len(rep.Errors) != 1 {
+		t.Errorf("Expected a broken template to fail the requests, found %v", rep.Errors)
+	}
+}
+
+func TestSigV4Signer(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite.
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	s := &SigV4Signer{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+		now:       func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	if err := s.Sign(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Expected the signature of the test suite\n%s, found\n%s", want, got)
+	}
+	if got := canonicalQuery(url.Values{"b": {"x y"}, "a": {"~1", "*"}}); got != "a=%2A&a=~1&b=x%20y" {
+		t.Errorf("Query was not canonicalized correctly, found %q", got)
+	}
+}
+
+func TestJWTSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	// verify checks the token and returns its claims.
+	verify := func(token string, alg string) map[string]interface{} {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			t.Fatalf("Expected a JWT, found %q", token)
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		signed := parts[0] + "." + parts[1]
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(signed))
+			if !hmac.Equal(sig, mac.Sum(nil)) {
+				t.Errorf("HS256 signature does not verify")
+			}
+		case "RS256":
+			hash := sha256.Sum256([]byte(signed))
+			if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+				t.Errorf("RS256 signature does not verify: %v", err)
+			}
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatal(err)
+		}
+		return claims
+	}
+
+	sign := func(s *JWTSigner) string {
+		req, _ := http.NewRequest("POST", "http://example.com/detect", nil)
+		if err := s.Sign(req, []byte("body")); err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+
+	s := &JWTSigner{Alg: "HS256", Key: []byte("secret"), TTL: time.Minute, Claims: `{"sub":"load","path":"{{.Path}}","jti":"{{.Nonce}}","iat":{{.Now}},"exp":{{.Exp}}}`}
+	token := sign(s)
+	claims := verify(token, "HS256")
+	if claims["sub"] != "load" || claims["path"] != "/detect" || claims["exp"].(float64)-claims["iat"].(float64) != 60 {
+		t.Errorf("Expected the templated claims, found %v", claims)
+	}
+	if sign(s) != token {
+		t.Errorf("Expected the token to be reused until it is due for refresh")
+	}
+	s.refresh = time.Now().Add(-time.Second)
+	if sign(s) == token {
+		t.Errorf("Expected a new token once the old one is due for refresh")
+	}
+
+	s = &JWTSigner{Alg: "RS256", Key: pemKey, PerRequest: true, Claims: `{"jti":"{{.Nonce}}"}`}
+	first, second := sign(s), sign(s)
+	if verify(first, "RS256")["jti"] == verify(second, "RS256")["jti"] {
+		t.Errorf("Expected a token with a new nonce for every request")
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if err := (&JWTSigner{Alg: "none"}).Sign(req, nil); err == nil {
+		t.Errorf("Expected an unsupported algorithm to fail")
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	var mu sync.Mutex
+	expiry := make(map[string]time.Time)
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "client" || secret != "s3cret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "read write" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"invalid_client"}`)
+			return
+		}
+		mu.Lock()
+		token := fmt.Sprintf("token-%d", len(expiry))
+		expiry[token] = time.Now().Add(time.Second)
+		mu.Unlock()
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":1}`, token)
+	}))
+	defer tokenServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		valid := time.Now().Before(expiry[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")])
+		mu.Unlock()
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	conf := &OAuth2Config{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "s3cret", Scopes: []string{"read", "write"}}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, C: 2, QPS: 40, PerformanceTimeout: 1500 * time.Millisecond, DisableOutput: true, OAuth2: conf}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second token is issued 0.8s in, while the first is still valid.
+	if rep.StatusCodes[401] != 0 || rep.StatusCodes[200] == 0 {
+		t.Errorf("Expected every request to carry an unexpired token, found %v", rep.StatusCodes)
+	}
+	if s := rep.Token; s == nil || s.Requests < 2 || s.Failed != 0 {
+		t.Errorf("Expected the token to be refreshed, found %+v", s)
+	}
+	if rep.StatusCodes[200] != rep.Requests {
+		t.Errorf("Expected the token requests to be left out of the results, found %d responses and %v", rep.Requests, rep.StatusCodes)
+	}
+
+	w.OAuth2 = &OAuth2Config{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "wrong"}
+	if _, err := w.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("Expected the run to fail without a token, found %v", err)
+	}
+
+	// No token is fetched for a run that cannot use it.
+	mu.Lock()
+	issued := len(expiry)
+	mu.Unlock()
+	w.OAuth2, w.GRPC = conf, true
+	if _, err := w.Run(context.Background()); err == nil {
+		t.Errorf("Expected OAuth2 to be rejected for gRPC")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expiry) != issued {
+		t.Errorf("Expected no token request for a rejected run, found %d", len(expiry)-issued)
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/headers":
+			time.Sleep(200 * time.Millisecond)
+		case "/body":
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("b"))
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/headers", "first byte timeout"},
+		{"/body", "body timeout"},
+		{"/fast", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+		w := &Work{
+			Request:          req,
+			N:                2,
+			C:                1,
+			DisableOutput:    true,
+			DialTimeout:      time.Second,
+			FirstByteTimeout: 50 * time.Millisecond,
+			BodyTimeout:      50 * time.Millisecond,
+		}
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == "" {
+			if len(rep.Errors) != 0 || rep.StatusCodes[200] != 2 {
+				t.Errorf("%s: expected 2 responses, found %v and %v", tt.path, rep.StatusCodes, rep.Errors)
+			}
+			continue
+		}
+		if rep.Errors[tt.want] != 2 {
+			t.Errorf("%s: expected 2 %q errors, found %v", tt.path, tt.want, rep.Errors)
+		}
+	}
+
+	if c := errorClass(&TimeoutError{Phase: "dial"}); c != "timeout" {
+		t.Errorf("Expected a dial timeout to be classed as timeout, found %q", c)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		// Every other request is slow, so every slow one is hedged and
+		// its duplicate wins.
+		if atomic.AddInt64(&count, 1)%2 == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		N:             5,
+		C:             1,
+		DisableOutput: true,
+		Hedge:         true,
+		HedgeDelay:    50 * time.Millisecond,
+	}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := rep.Hedges; s == nil || s.Requests != 5 || s.Hedged != 5 || s.Won != 5 {
+		t.Errorf("Expected all 5 requests to be hedged and won by the duplicate, found %+v", s)
+	}
+	if rep.StatusCodes[200] != 5 || len(rep.Errors) != 0 {
+		t.Errorf("Expected 5 responses, found %v and %v", rep.StatusCodes, rep.Errors)
+	}
+	if rep.Slowest < 50*time.Millisecond || rep.Slowest > 500*time.Millisecond {
+		t.Errorf("Expected hedged requests to take the delay plus the duplicate, found %v", rep.Slowest)
+	}
+
+	var win latencyWindow
+	for i := 1; i <= 100; i++ {
+		win.add(time.Duration(i) * time.Millisecond)
+	}
+	if d, ok := win.delay(); !ok || d != 96*time.Millisecond {
+		t.Errorf("Expected a p95 delay of 96ms, found %v", d)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	for _, lg := range []*log.Logger{Debug, Info, Warning, Error} {
+		lg := lg
+		out, flags, prefix := lg.Writer(), lg.Flags(), lg.Prefix()
+		t.Cleanup(func() {
+			lg.SetOutput(out)
+			lg.SetFlags(flags)
+			lg.SetPrefix(prefix)
+		})
+	}
+
+	var buf bytes.Buffer
+	SetLogger(NewLogger(&buf, slog.LevelWarn, true))
+	Debug.Printf("hidden debug\n")
+	Info.Printf("hidden response\n")
+	Error.Printf("boom %d\n", 1)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Expected a single JSON record, found %q", buf.String())
+	}
+	if rec["level"] != "ERROR" || rec["msg"] != "boom 1" {
+		t.Errorf("Expected the error record, found %v", rec)
+	}
+}
+
+func TestSilentByDefault(t *testing.T) {
+	for _, lg := range []*log.Logger{Debug, Info, Warning, Error} {
+		if lg.Writer() != io.Discard {
+			t.Errorf("Expected the loggers to discard by default, found %T", lg.Writer())
+		}
+	}
+	if (&Work{}).printResponses() {
+		t.Errorf("Expected the responses not to be read for printing by default")
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	p, z := mannWhitney([]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10})
+	if z >= 0 || math.Abs(p-0.009) > 0.001 {
+		t.Errorf("Expected p = 0.009 with a smaller first sample, found p = %v, z = %v", p, z)
+	}
+	if p, _ := mannWhitney([]float64{1, 2, 2, 3}, []float64{1, 2, 2, 3}); p != 1 {
+		t.Errorf("Expected p = 1 for identical samples, found %v", p)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	run := func(lats []float64, errs int) *Report {
+		r := newReport(nil, nil)
+		r.timeUsed = time.Second
+		for _, l := range lats {
+			r.lats = append(r.lats, l)
+			r.avgTotal += l
+		}
+		r.connLats, r.dnsLats, r.tlsLats = r.lats, r.lats, r.lats
+		r.reqLats, r.delayLats, r.resLats = r.lats, r.lats, r.lats
+		if errs > 0 {
+			r.errorDist["boom"] = errs
+		}
+		r.calculate()
+		// Round trip through the saved form.
+		var buf bytes.Buffer
+		if err := (&JSONRenderer{W: &buf}).Render(r.summary()); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := LoadReport(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+	var fast, slow []float64
+	for i := 0; i < 200; i++ {
+		fast = append(fast, 0.010+float64(i%10)/1000)
+		slow = append(slow, 0.015+float64(i%10)/1000)
+	}
+	tol := Tolerance{Latency: 0.1, RPS: 0.1, ErrorRate: 0.01}
+
+	if c := Compare(run(fast, 0), run(fast, 0), tol); len(c.Regressions) != 0 || c.P != 1 {
+		t.Errorf("Expected no regression comparing a run with itself, found %+v", c)
+	}
+	c := Compare(run(fast, 0), run(slow, 0), tol)
+	if !c.Slower || c.P > 0.05 || len(c.Regressions) == 0 {
+		t.Errorf("Expected significant latency regressions, found %+v", c)
+	}
+	var out bytes.Buffer
+	c.Print(&out)
+	if !strings.Contains(out.String(), "p50 is") || !strings.Contains(out.String(), "Requests/sec") {
+		t.Errorf("Expected the table and the p50 regression, found %q", out.String())
+	}
+	if c := Compare(run(slow, 0), run(fast, 0), tol); len(c.Regressions) != 0 {
+		t.Errorf("Expected no regression for a faster run, found %v", c.Regressions)
+	}
+	c = Compare(run(fast, 0), run(fast[:100], 10), tol)
+	if len(c.Regressions) != 2 {
+		t.Errorf("Expected RPS and error rate regressions, found %v", c.Regressions)
+	}
+}
+
+func TestStress(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, "ok")
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	for _, async := range []bool{false, true} {
+		atomic.StoreInt64(&count, 0)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		failReq, _ := http.NewRequest("GET", server.URL+"?fail=1", nil)
+		var calls int
+		w := &Work{
+			Request:       req,
+			N:             5000,
+			C:             50,
+			Async:         async,
+			DisableOutput: true,
+			OnResult:      func(Result) { calls++ },
+		}
+		if async {
+			w.Request = failReq
+		}
+		rep, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := http.StatusOK
+		if async {
+			want = http.StatusInternalServerError
+		}
+		if atomic.LoadInt64(&count) != 5000 || calls != 5000 || rep.Requests != 5000 {
+			t.Errorf("Expected 5000 requests, results and callbacks, found %v, %v and %v", atomic.LoadInt64(&count), rep.Requests, calls)
+		}
+		if rep.StatusCodes[want] != 5000 || rep.SizeTotal != 5000*2 {
+			t.Errorf("Expected 5000 responses with status %d and 10000 bytes, found %v and %v", want, rep.StatusCodes, rep.SizeTotal)
+		}
+	}
+}
+
+func TestStressErrors(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	w := &Work{
+		Request:       req,
+		N:             2000,
+		C:             40,
+		DisableOutput: true,
+	}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs int
+	for _, num := range rep.Errors {
+		errs += num
+	}
+	if errs != 2000 || rep.Requests != 0 {
+		t.Errorf("Expected 2000 errors and no responses, found %v and %v", errs, rep.Requests)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	w := &Work{
+		Request: req,
+		RequestParamSlice: &RequestParamSlice{RequestParams: []RequestParam{
+			{Content: []byte(`{"kind": "a"}`)},
+			{Content: []byte(`{"kind": "b"}`)},
+		}},
+		N:             10,
+		C:             2,
+		DisableOutput: true,
+		Metrics:       m,
+		TestName:      "smoke",
+		TagField:      "kind",
+	}
+	w.Run(context.Background())
+	for _, tag := range []string{"a", "b"} {
+		if got := testutil.ToFloat64(m.requests.WithLabelValues("smoke", tag, "200")); got != 5 {
+			t.Errorf("Expected 5 responses tagged %s, found %v", tag, got)
+		}
+	}
+	if got := testutil.ToFloat64(m.inFlight.WithLabelValues("smoke")); got != 0 {
+		t.Errorf("Expected no requests in flight, found %v", got)
+	}
+	if got := testutil.CollectAndCount(m.durations); got != 14 {
+		t.Errorf("Expected 7 phases for 2 tags, found %v series", got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "canceled"},
+		{&url.Error{Op: "Get", Err: context.DeadlineExceeded}, "timeout"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{&net.DNSError{Err: "no such host", Name: "x"}, "dns"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("Expected %v to be classed %s, found %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+// runWithSink runs n requests against an empty handler and feeds the
+// results to sink.
+func runWithSink(t *testing.T, n int, sink Sink) *Report {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	w := &Work{
+		Request: req,
+		RequestParamSlice: &RequestParamSlice{RequestParams: []RequestParam{
+			{Content: []byte(`{"kind": "a b"}`)},
+		}},
+		N:             n,
+		C:             2,
+		DisableOutput: true,
+		TagField:      "kind",
+		Sinks:         []Sink{sink},
+	}
+	rep, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Sinks) != 1 || rep.Sinks[0].Written != n {
+		t.Errorf("Expected %d results written to the sink, found %+v", n, rep.Sinks)
+	}
+	return rep
+}
+
+func TestInfluxSink(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Expected the token to be sent, found %q", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	runWithSink(t, 20, &InfluxSink{URL: server.URL + "/api/v2/write?bucket=b", Token: "secret", Test: "soak"})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 20 {
+		t.Fatalf("Expected 20 points, found %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], `meg_request,test=soak,tag=a\ b,code=200 duration=`) {
+		t.Errorf("Expected a point with test, tag and code, found %q", lines[0])
+	}
+}
+
+func TestOTLPSink(t *testing.T) {
+	var mu sync.Mutex
+	var requests, histCount int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var exp otlpExport
+		if err := json.NewDecoder(r.Body).Decode(&exp); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range exp.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			switch {
+			case m.Name == "meg.requests":
+				for _, p := range m.Sum.DataPoints {
+					n, _ := strconv.ParseInt(p.AsInt, 10, 64)
+					requests += n
+				}
+			case m.Name == "meg.request.duration":
+				for _, p := range m.Histogram.DataPoints {
+					n, _ := strconv.ParseInt(p.Count, 10, 64)
+					histCount += n
+					if len(p.BucketCounts) != len(p.ExplicitBounds)+1 {
+						t.Errorf("Expected one more bucket than bounds, found %d and %d", len(p.BucketCounts), len(p.ExplicitBounds))
+					}
+				}
+			}
+		}
+	}))
+	defer server.Close()
+
+	runWithSink(t, 20, &OTLPSink{URL: server.URL + "/v1/metrics", Test: "soak"})
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 20 || histCount != 20 {
+		t.Errorf("Expected 20 requests in the counter and the histogram, found %d and %d", requests, histCount)
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	lines := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				lines <- line
+			}
+		}
+	}()
+
+	runWithSink(t, 20, &StatsdSink{Addr: pc.LocalAddr().String()})
+	var counts, timers int
+	timeout := time.After(2 * time.Second)
+	for counts+timers < 40 {
+		select {
+		case line := <-lines:
+			switch {
+			case line == "meg.a_b.requests.200:1|c":
+				counts++
+			case strings.HasPrefix(line, "meg.a_b.duration:") && strings.HasSuffix(line, "|ms"):
+				timers++
+			default:
+				t.Errorf("Unexpected line %q", line)
+			}
+		case <-timeout:
+			t.Fatalf("Expected 20 counts and 20 timers, found %d and %d", counts, timers)
+		}
+	}
+}
+
+// blockingSink blocks every write until release is closed.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(results []Result) error {
+	<-s.release
+	return nil
+}
+
+func TestSinkBackPressure(t *testing.T) {
+	s := &blockingSink{release: make(chan struct{})}
+	sw := startSink(s)
+	n := 2 * sinkQueue
+	for i := 0; i < n; i++ {
+		sw.feed(Result{})
+	}
+	close(s.release)
+	stats := sw.close()
+	if stats.Dropped == 0 || stats.Written+stats.Dropped != n {
+		t.Errorf("Expected a slow sink to drop results, found %+v", stats)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		N:             100000,
+		C:             2,
+		DisableOutput: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once the context is cancelled")
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	var started, done int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&started, 1)
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt64(&done, 1)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		grace   time.Duration
+		aborted bool
+	}{
+		{grace: time.Second, aborted: false},
+		{grace: 0, aborted: true},
+	} {
+		atomic.StoreInt64(&started, 0)
+		atomic.StoreInt64(&done, 0)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{
+			Request:       req,
+			N:             100,
+			C:             2,
+			GracePeriod:   tt.grace,
+			DisableOutput: true,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		s := time.Now()
+		rep, _ := w.Run(ctx)
+		elapsed := time.Now().Sub(s)
+		cancel()
+		if !rep.Interrupted {
+			t.Errorf("Expected the report to be marked interrupted")
+		}
+		if got := atomic.LoadInt64(&started); got != 2 {
+			t.Errorf("Expected 2 requests to be sent, found %v", got)
+		}
+		if tt.aborted {
+			if elapsed > 150*time.Millisecond {
+				t.Errorf("Expected in-flight requests to be aborted, Run took %v", elapsed)
+			}
+		} else {
+			if got := atomic.LoadInt64(&done); got != 2 {
+				t.Errorf("Expected in-flight requests to complete, %v completed", got)
+			}
+			if len(rep.Errors) > 0 {
+				t.Errorf("Expected no errors, found %v", rep.Errors)
+			}
+		}
+	}
+}
+
+func TestH2Conns(t *testing.T) {
+	var mu sync.Mutex
+	addrs := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Expected an HTTP/2 request, found %v", r.Proto)
+		}
+		mu.Lock()
+		addrs[r.RemoteAddr]++
+		mu.Unlock()
+	}
+	var closed int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			atomic.AddInt64(&closed, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:          req,
+		N:                40,
+		C:                10,
+		H2:               true,
+		H2Conns:          2,
+		H2StreamsPerConn: 3,
+		DisableOutput:    true,
+	}
+	w.Run(context.Background())
+	if len(addrs) != 2 {
+		t.Errorf("Expected 2 connections, found %v", len(addrs))
+	}
+	var total int64
+	for _, c := range w.h2Conns {
+		total += c.requests
+		if c.maxActive > 3 {
+			t.Errorf("Expected at most 3 concurrent streams on connection %d, found %v", c.idx, c.maxActive)
+		}
+	}
+	if total != 40 {
+		t.Errorf("Expected 40 streams, found %v", total)
+	}
+	// The connections are closed once the test is over.
+	for i := 0; i < 100 && atomic.LoadInt64(&closed) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&closed); n != 2 {
+		t.Errorf("Expected the 2 connections to be closed after the test, found %v", n)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt64(&count, 1)
+		}
+	}
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		N:             10,
+		C:             5,
+		H2:            true,
+		H2C:           true,
+		H2Conns:       1,
+		DisableOutput: true,
+	}
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 10 {
+		t.Errorf("Expected 10 h2c requests, found %v", atomic.LoadInt64(&count))
+	}
+}
+
+func TestH2RSTStream(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		N:             4,
+		C:             2,
+		H2:            true,
+		H2C:           true,
+		H2Conns:       1,
+		DisableOutput: true,
+	}
+	w.Run(context.Background())
+	if n := atomic.LoadInt64(&w.h2Conns[0].rstStreams); n != 4 {
+		t.Errorf("Expected 4 RST_STREAM errors, found %v", n)
+	}
+}
+
+// newH3Server starts an in-process HTTP/3 server on a loopback UDP port and
+// returns its https URL.
+func newH3Server(t *testing.T, handler http.Handler) string {
+	ts := httptest.NewTLSServer(handler)
+	certs := ts.TLS.Certificates
+	ts.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: certs},
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return "https://" + conn.LocalAddr().String()
+}
+
+func TestH3(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 3 {
+			atomic.AddInt64(&count, 1)
+		}
+	}
+	url := newH3Server(t, http.HandlerFunc(handler))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	var out bytes.Buffer
+	w := &Work{
+		Request:       req,
+		N:             10,
+		C:             2,
+		H3:            true,
+		DisableOutput: true,
+		Renderer:      &TextRenderer{W: &out},
+	}
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 10 {
+		t.Errorf("Expected 10 HTTP/3 requests, found %v", atomic.LoadInt64(&count))
+	}
+	if !bytes.Contains(out.Bytes(), []byte("TLS handshake")) {
+		t.Errorf("Expected the report to include the handshake phase")
+	}
+}
+
+func TestH3ZeroRTT(t *testing.T) {
+	var count, early int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt64(&count, 1)
+		}
+		if r.TLS != nil && !r.TLS.HandshakeComplete {
+			atomic.AddInt64(&early, 1)
+		}
+	}
+	url := newH3Server(t, http.HandlerFunc(handler))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	// Every request dials a new connection, so all but the first can
+	// resume the session and send the request as early data.
+	w := &Work{
+		Request:           req,
+		N:                 5,
+		C:                 1,
+		H3:                true,
+		H3ZeroRTT:         true,
+		DisableKeepAlives: true,
+		DisableOutput:     true,
+	}
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 5 {
+		t.Errorf("Expected 5 GET requests, found %v", atomic.LoadInt64(&count))
+	}
+	if atomic.LoadInt64(&early) == 0 {
+		t.Errorf("Expected requests sent as 0-RTT early data, found none")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	var count int64
+	handler := func(ws *websocket.Conn) {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+			atomic.AddInt64(&count, 1)
+			websocket.Message.Send(ws, msg)
+		}
+	}
+	server := httptest.NewServer(websocket.Handler(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	w := &Work{
+		Request: req,
+		RequestParamSlice: &RequestParamSlice{
+			RequestParams: []RequestParam{{Content: []byte("a")}, {Content: []byte("b")}},
+		},
+		N:             20,
+		C:             2,
+		DisableOutput: true,
+	}
+	w.Run(context.Background())
+	if atomic.LoadInt64(&count) != 20 {
+		t.Errorf("Expected 20 messages, found %v", atomic.LoadInt64(&count))
+	}
+	ws := w.report.ws
+	if ws.connects != 2 || ws.sent != 20 || ws.received != 20 || ws.disconnects != 0 {
+		t.Errorf("Unexpected WebSocket stats: %d connects, %d sent, %d received, %d disconnects",
+			ws.connects, ws.sent, ws.received, ws.disconnects)
+	}
+}
+
+func TestWebSocketIDField(t *testing.T) {
+	handler := func(ws *websocket.Conn) {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+			// An unrelated push arrives before every reply.
+			websocket.Message.Send(ws, `{"event":"tick"}`)
+			websocket.Message.Send(ws, msg)
+		}
+	}
+	server := httptest.NewServer(websocket.Handler(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	w := &Work{
+		Request: req,
+		RequestParamSlice: &RequestParamSlice{
+			RequestParams: []RequestParam{{Content: []byte(`{"id": 1}`)}, {Content: []byte(`{"id": 2}`)}},
+		},
+		WSIDField:     "id",
+		N:             10,
+		C:             1,
+		DisableOutput: true,
+	}
+	w.Run(context.Background())
+	ws := w.report.ws
+	if ws.sent != 10 || ws.received != 20 {
+		t.Errorf("Expected 10 sent and 20 received messages, found %d and %d", ws.sent, ws.received)
+	}
+}
+
+func TestWebSocketDisconnect(t *testing.T) {
+	handler := func(ws *websocket.Conn) {
+		var msg string
+		if websocket.Message.Receive(ws, &msg) == nil {
+			websocket.Message.Send(ws, msg)
+		}
+	}
+	server := httptest.NewServer(websocket.Handler(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	w := &Work{
+		Request:       req,
+		N:             4,
+		C:             1,
+		DisableOutput: true,
+	}
+	rep, _ := w.Run(context.Background())
+	ws := w.report.ws
+	// Every second message finds the connection closed by the server.
+	if ws.connects != 2 || ws.disconnects != 2 || ws.received != 2 {
+		t.Errorf("Unexpected WebSocket stats: %d connects, %d received, %d disconnects",
+			ws.connects, ws.received, ws.disconnects)
+	}
+	if failed := countErrors(rep); rep.Requests != 2 || failed != 2 {
+		t.Errorf("Expected 2 replies and 2 failed messages, found %d and %d", rep.Requests, failed)
+	}
+
+	// Messages that find no server fail, and the worker goes on dialing.
+	server.Close()
+	w.N = 3
+	rep, _ = w.Run(context.Background())
+	if failed := countErrors(rep); rep.Requests != 0 || failed != 3 {
+		t.Errorf("Expected 3 failed dials, found %d replies and %d errors", rep.Requests, failed)
+	}
+}
+
+func countErrors(rep *Report) int {
+	n := 0
+	for _, num := range rep.Errors {
+		n += num
+	}
+	return n
+}
+
+var registerEchoProto sync.Once
+
+// newGRPCServer serves testdata/echo.proto with reflection enabled and
+// returns its http url. The server echoes the message and fails the call
+// with the status code in the message's code field.
+func newGRPCServer(t *testing.T, count *int64) string {
+	fds, err := (&protoparse.Parser{ImportPaths: []string{"testdata"}}).ParseFiles("echo.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := fds[0].UnwrapFile()
+	registerEchoProto.Do(func() {
+		protoregistry.GlobalFiles.RegisterFile(fd)
+	})
+	md := fd.Services().ByName("Echo").Methods().ByName("Say")
+
+	handler := func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := dynamicpb.NewMessage(md.Input())
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(count, 1)
+		if m, _ := metadata.FromIncomingContext(ctx); len(m.Get("x-token")) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "missing x-token")
+		}
+		if code := in.Get(md.Input().Fields().ByName("code")).Int(); code != 0 {
+			return nil, status.Error(codes.Code(code), "failed")
+		}
+		return in, nil
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "echo.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods:     []grpc.MethodDesc{{MethodName: "Say", Handler: handler}},
+	}, struct{}{})
+	reflection.Register(server)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return "http://" + l.Addr().String()
+}
+
+func TestGRPC(t *testing.T) {
+	var count int64
+	url := newGRPCServer(t, &count)
+
+	for _, proto := range []string{"testdata/echo.proto", ""} {
+		atomic.StoreInt64(&count, 0)
+		req, _ := http.NewRequest("POST", url, nil)
+		req.Header.Set("X-Token", "secret")
+		w := &Work{
+			Request: req,
+			RequestParamSlice: &RequestParamSlice{
+				RequestParams: []RequestParam{
+					{Content: []byte(`{"text": "hello"}`)},
+					{Content: []byte(`{"text": "boom", "code": 14}`)},
+				},
+			},
+			GRPC:          true,
+			GRPCCall:      "echo.Echo/Say",
+			GRPCProto:     proto,
+			N:             10,
+			C:             1,
+			DisableOutput: true,
+		}
+		w.Run(context.Background())
+		if atomic.LoadInt64(&count) != 10 {
+			t.Errorf("Expected 10 calls with proto %q, found %v", proto, atomic.LoadInt64(&count))
+		}
+		if w.grpcMethod == nil || w.grpcMethod.FullName() != protoreflect.FullName("echo.Echo.Say") {
+			t.Errorf("Expected echo.Echo.Say to be resolved with proto %q", proto)
+		}
+	}
+}
+
+func TestGRPCStatusCodes(t *testing.T) {
+	var count int64
+	url := newGRPCServer(t, &count)
+
+	req, _ := http.NewRequest("POST", url, nil)
+	w := &Work{
+		Request:       req,
+		GRPC:          true,
+		GRPCCall:      "echo.Echo.Say",
+		GRPCProto:     "testdata/echo.proto",
+		N:             1,
+		C:             1,
+		DisableOutput: true,
+	}
+	w.results = make(chan *Result, 1)
+	md, err := w.resolveGRPCMethod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.grpcMethod, w.grpcFullMethod = md, "/echo.Echo/Say"
+	conn, err := w.grpcDial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		md   metadata.MD
+		body string
+		code codes.Code
+	}{
+		{metadata.Pairs("x-token", "a"), `{"text": "hi"}`, codes.OK},
+		{metadata.Pairs("x-token", "a"), `{"code": 8}`, codes.ResourceExhausted},
+		{metadata.Pairs("x-token", "a"), `{"code": 14}`, codes.Unavailable},
+		{metadata.MD{}, `{}`, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		w.grpcInvoke(conn, tt.md, &RequestParam{Content: []byte(tt.body)})
+		res := <-w.results
+		if codes.Code(res.StatusCode) != tt.code || res.Err != nil {
+			t.Errorf("Expected status %v for %s, found %v, %v", tt.code, tt.body, codes.Code(res.StatusCode), res.Err)
+		}
+	}
+
+	// A call no server answers fails without a status.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	down := *w
+	down.Request, _ = http.NewRequest("POST", "http://"+l.Addr().String(), nil)
+	downConn, err := down.grpcDial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downConn.Close()
+	down.grpcInvoke(downConn, metadata.Pairs("x-token", "a"), &RequestParam{Content: []byte(`{}`)})
+	if res := <-w.results; res.Err == nil || res.StatusCode != 0 {
+		t.Errorf("Expected the call to fail without a status, found %v, %v", codes.Code(res.StatusCode), res.Err)
+	}
+
+	// An input row that is no request message fails the call.
+	w.grpcInvoke(conn, metadata.Pairs("x-token", "a"), &RequestParam{Content: []byte(`{"text": 1}`)})
+	if res := <-w.results; res.Err == nil {
+		t.Errorf("Expected an invalid request message to fail, found status %v", codes.Code(res.StatusCode))
+	}
+
+	// Only failed calls are captured with ErrorsOnly.
+	var buf bytes.Buffer
+	w.Capture = &Capture{W: &buf, ErrorsOnly: true}
+	for _, body := range []string{`{"text": "hi"}`, `{"code": 8}`} {
+		w.grpcInvoke(conn, metadata.Pairs("x-token", "a"), &RequestParam{Content: []byte(body)})
+		<-w.results
+	}
+	if err := w.Capture.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 || !strings.Contains(buf.String(), `"status":8`) {
+		t.Errorf("Expected the failed call to be captured, found %q", buf.String())
+	}
+}
+
+func TestStream(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "data: token\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:       req,
+		Stream:        true,
+		DisableOutput: true,
+	}
+	w.results = make(chan *Result, 1)
+	var out bytes.Buffer
+	r := newReport(nil, nil)
+	r.w = &out
+	for i := 0; i < 2; i++ {
+		w.makeRequest(&http.Client{}, &RequestParam{})
+		res := <-w.results
+		st := res.stream
+		if st == nil || st.events != 3 || len(st.gaps) != 2 {
+			t.Fatalf("Expected 3 events and 2 gaps, found %+v", st)
+		}
+		for _, gap := range st.gaps {
+			if gap < 5*time.Millisecond {
+				t.Errorf("Expected gaps of about 10ms, found %v", gap)
+			}
+		}
+		if st.firstEvent <= 0 || st.firstEvent > res.Duration {
+			t.Errorf("Expected the first event within the response time, found %v", st.firstEvent)
+		}
+		if st.body.Len() > 0 {
+			t.Errorf("Expected no body to be kept without capture, found %q", st.body.String())
+		}
+		r.addStream(st)
+	}
+	r.printStreams()
+	if !strings.Contains(out.String(), "Time to first event") {
+		t.Errorf("Expected the report to include the streaming section")
+	}
+	// Only as much of the body as is captured is kept.
+	var buf bytes.Buffer
+	w.Capture = &Capture{W: &buf, MaxBody: 10}
+	w.makeRequest(&http.Client{}, &RequestParam{})
+	if st := (<-w.results).stream; st.body.Len() != 11 {
+		t.Errorf("Expected 11 bytes of the body to be kept, found %q", st.body.String())
+	}
+	w.Capture.flush()
+	var c CapturedResponse
+	if err := json.Unmarshal(buf.Bytes(), &c); err != nil || c.Body != "data: toke" || !c.Truncated {
+		t.Errorf("Expected the captured body to be cut off, found %+v", c)
+	}
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := io.WriteString(w, `{"token": "x"}`+"\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:           req,
+		Stream:            true,
+		StreamDelimiter:   "\n",
+		MaxStreamDuration: 100 * time.Millisecond,
+		DisableOutput:     true,
+	}
+	w.results = make(chan *Result, 1)
+	w.makeRequest(&http.Client{}, &RequestParam{})
+	st := (<-w.results).stream
+	if st == nil || !st.truncated {
+		t.Fatalf("Expected a cut off stream, found %+v", st)
+	}
+	if st.events < 3 {
+		t.Errorf("Expected several events before the cut off, found %v", st.events)
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		agent := httptest.NewServer(&Agent{})
+		defer agent.Close()
+		addrs = append(addrs, strings.TrimPrefix(agent.URL, "http://"))
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var out bytes.Buffer
+	c := &Coordinator{
+		Agents: addrs,
+		Work: &Work{
+			Request:       req,
+			N:             31,
+			C:             3,
+			DisableOutput: true,
+			Renderer:      &TextRenderer{W: &out},
+		},
+		StartDelay: 50 * time.Millisecond,
+	}
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 31 is split into 11, 10 and 10 requests, each run by one worker.
+	if atomic.LoadInt64(&count) != 31 {
+		t.Errorf("Expected to boom 31 times, found %v", atomic.LoadInt64(&count))
+	}
+	if got := strings.Count(out.String(), " responses\n"); got < 4 {
+		t.Errorf("Expected status codes and all 3 agents in the report, found:\n%s", out.String())
+	}
+}
+
+func TestCoordinatorAgentFailure(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	good := httptest.NewServer(&Agent{})
+	defer good.Close()
+	// The second agent dies while the test runs.
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/result" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+	}))
+	defer bad.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var out bytes.Buffer
+	c := &Coordinator{
+		Agents: []string{good.URL, bad.URL},
+		Work: &Work{
+			Request:       req,
+			N:             10,
+			C:             2,
+			DisableOutput: true,
+			Renderer:      &TextRenderer{W: &out},
+		},
+		StartDelay: 10 * time.Millisecond,
+	}
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "["+bad.URL+"]\tfailed: ") {
+		t.Errorf("Expected the failed agent in the report, found:\n%s", out.String())
+	}
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}))
+	defer server.Close()
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		agent := httptest.NewServer(&Agent{})
+		defer agent.Close()
+		addrs = append(addrs, agent.URL)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	c := &Coordinator{
+		Agents:     addrs,
+		Work:       &Work{Request: req, N: 1000, C: 2, QPS: 20, DisableOutput: true},
+		StartDelay: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	rep, err := c.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Interrupted || rep.Requests == 0 || rep.Requests > 20 {
+		t.Errorf("Expected the agents to stop after a few requests, found %d, interrupted %v", rep.Requests, rep.Interrupted)
+	}
+	// The agents send nothing more once stopped.
+	sent := atomic.LoadInt64(&count)
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&count); n != sent {
+		t.Errorf("Expected the agents to stop, found %d more requests", n-sent)
+	}
+
+	c.Work.OAuth2 = &OAuth2Config{TokenURL: server.URL, ClientID: "client"}
+	if _, err := c.Run(context.Background()); err == nil {
+		t.Errorf("Expected OAuth2 to be rejected with agents")
+	}
+}
+
+func TestCoordinatorStartFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	good := httptest.NewServer(&Agent{})
+	defer good.Close()
+	// The second agent fails to start after the first one has started.
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Error(w, "no", http.StatusConflict)
+		}
+	}))
+	defer bad.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	c := &Coordinator{
+		Agents:     []string{good.URL, bad.URL},
+		Work:       &Work{Request: req, N: 1000, C: 1, QPS: 10, DisableOutput: true},
+		StartDelay: 10 * time.Millisecond,
+	}
+	if _, err := c.Run(context.Background()); err == nil {
+		t.Fatal("Expected the failed start to fail the run")
+	}
+
+	// The first agent was reset and takes the next test.
+	c.Agents = []string{good.URL}
+	c.Work.N = 5
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	agent := httptest.NewServer(&Agent{})
+	defer agent.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	c := &Coordinator{
+		Agents: []string{agent.URL},
+		Work:   &Work{Request: req, N: 20, C: 2, DisableOutput: true},
+	}
+	ctx := context.Background()
+	if err := c.post(ctx, agent.URL, "/prepare", c.plan(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.post(ctx, agent.URL, "/start", startSpec{StartAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// Only one of the concurrent calls gets the result.
+	var collected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if snap, err := c.fetchResult(ctx, agent.URL); err == nil && len(snap.Lats) == 20 {
+				atomic.AddInt64(&collected, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if collected != 1 {
+		t.Errorf("Expected the result to be collected once, found %d", collected)
+	}
+
+	// A result nobody collects does not keep the agent busy.
+	if err := c.post(ctx, agent.URL, "/prepare", c.plan(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.post(ctx, agent.URL, "/start", startSpec{StartAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := c.post(ctx, agent.URL, "/prepare", c.plan(0)); err != nil {
+		t.Errorf("Expected the finished test to be dropped, found %v", err)
+	}
+}
+
+func TestAgentToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	agent := httptest.NewServer(&Agent{Token: "secret"})
+	defer agent.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	c := &Coordinator{
+		Agents:     []string{agent.URL},
+		Work:       &Work{Request: req, N: 5, C: 1, DisableOutput: true},
+		StartDelay: 10 * time.Millisecond,
+	}
+	if _, err := c.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the agent to refuse a call without the token, found %v", err)
+	}
+	c.Token = "secret"
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoordinatorOnce(t *testing.T) {
+	params := &RequestParamSlice{}
+	for i := 0; i < 10; i++ {
+		params.RequestParams = append(params.RequestParams, RequestParam{Content: []byte{'0' + byte(i)}})
+	}
+	req, _ := http.NewRequest("POST", "http://example.com", nil)
+	c := &Coordinator{
+		Agents: []string{"a", "b", "c"},
+		Work:   &Work{Request: req, RequestParamSlice: params, C: 3, Once: true},
+	}
+	var got []byte
+	for i := range c.Agents {
+		for _, p := range c.plan(i).RequestParamSlice.RequestParams {
+			got = append(got, p.Content...)
+		}
+	}
+	if string(got) != "0123456789" {
+		t.Errorf("Expected the rows to be split across the agents, found %q", got)
+	}
+}
+
+func TestShare(t *testing.T) {
+	var total int
+	for i := 0; i < 3; i++ {
+		total += share(10, 3, i)
+	}
+	if total != 10 || share(10, 3, 0) != 4 || share(10, 3, 2) != 3 {
+		t.Errorf("Expected 10 to be split into 4, 3 and 3")
 	}
 }
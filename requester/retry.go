@@ -0,0 +1,230 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy retries HTTP requests that fail in one of the ways listed in
+// On, the way a client would. Only the last attempt of a request is
+// measured: the latency and status code of the earlier ones are not
+// reported, only how many there were and the time they took in all.
+type RetryPolicy struct {
+	// Max is the number of retries after the first attempt.
+	Max int
+
+	// On lists what is retried: "5xx" and "429" responses, "timeout"
+	// errors and "conn" errors, which are refused and reset connections
+	// and failed DNS lookups and TLS handshakes.
+	On []string
+
+	// Backoff is the wait before the first retry. With Exponential it
+	// doubles for every further retry, up to MaxBackoff if set. Every wait
+	// is shortened by a random jitter of up to half. A Retry-After header
+	// on a 429 or 503 response takes precedence, but is honoured only up
+	// to MaxBackoff, or 10s if MaxBackoff is not set.
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Exponential bool
+}
+
+// RetryStats tells how retries added to the load of a test.
+type RetryStats struct {
+	// Requests is the number of requests, however many attempts each took.
+	Requests int
+
+	// FirstFailed is the number of requests whose first attempt failed in
+	// a retryable way.
+	FirstFailed int
+
+	// Retried is the number of requests retried at least once.
+	Retried int
+
+	// GaveUp is the number of requests whose last attempt still failed in
+	// a retryable way.
+	GaveUp int
+
+	// Attempts is the number of attempts sent, first ones included.
+	Attempts int
+
+	// ByRetries maps a number of retries to the requests that took that
+	// many.
+	ByRetries map[int]int
+
+	// Elapsed is the sum of the end-to-end times of the requests, from
+	// their first attempt to their last with the waits between them, and
+	// SlowestElapsed the longest. The latencies of the report only cover
+	// the last attempt.
+	Elapsed        time.Duration
+	SlowestElapsed time.Duration
+}
+
+// Amplification is the number of attempts per request.
+func (s RetryStats) Amplification() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Attempts) / float64(s.Requests)
+}
+
+func (s *RetryStats) add(res *Result) {
+	if s.ByRetries == nil {
+		s.ByRetries = make(map[int]int)
+	}
+	attempts := max(res.Attempts, 1)
+	s.Requests++
+	s.Attempts += attempts
+	if attempts > 1 {
+		s.Retried++
+		s.ByRetries[attempts-1]++
+	}
+	if attempts > 1 || res.GaveUp {
+		s.FirstFailed++
+	}
+	if res.GaveUp {
+		s.GaveUp++
+	}
+	s.Elapsed += res.Elapsed
+	s.SlowestElapsed = max(s.SlowestElapsed, res.Elapsed)
+}
+
+func (s *RetryStats) merge(o *RetryStats) {
+	s.Requests += o.Requests
+	s.FirstFailed += o.FirstFailed
+	s.Retried += o.Retried
+	s.GaveUp += o.GaveUp
+	s.Attempts += o.Attempts
+	s.Elapsed += o.Elapsed
+	s.SlowestElapsed = max(s.SlowestElapsed, o.SlowestElapsed)
+	for n, num := range o.ByRetries {
+		if s.ByRetries == nil {
+			s.ByRetries = make(map[int]int)
+		}
+		s.ByRetries[n] += num
+	}
+}
+
+// validate checks the retry conditions of p.
+func (p *RetryPolicy) validate() error {
+	for _, on := range p.On {
+		switch on {
+		case "5xx", "429", "timeout", "conn":
+		default:
+			return fmt.Errorf("unknown retry condition %q, use 5xx, 429, timeout or conn", on)
+		}
+	}
+	return nil
+}
+
+// retryable reports whether res failed in a way p retries.
+func (p *RetryPolicy) retryable(res *Result) bool {
+	if p == nil {
+		return false
+	}
+	var cond string
+	switch {
+	case res.Err != nil:
+		switch errorClass(res.Err) {
+		case "timeout":
+			cond = "timeout"
+		case "refused", "reset", "dns", "tls":
+			cond = "conn"
+		}
+	case res.StatusCode == http.StatusTooManyRequests:
+		cond = "429"
+	case res.StatusCode/100 == 5:
+		cond = "5xx"
+	}
+	for _, on := range p.On {
+		if on == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// wait returns how long to wait before the retry-th retry.
+func (p *RetryPolicy) wait(retry int) time.Duration {
+	d := p.Backoff
+	if p.Exponential {
+		for i := 1; i < retry && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+			d *= 2
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// defaultMaxRetryAfter is the longest Retry-After wait honoured if the
+// policy has no MaxBackoff.
+const defaultMaxRetryAfter = 10 * time.Second
+
+// maxRetryAfter returns the longest Retry-After wait p honours.
+func (p *RetryPolicy) maxRetryAfter() time.Duration {
+	if p.MaxBackoff > 0 {
+		return p.MaxBackoff
+	}
+	return defaultMaxRetryAfter
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of a 429
+// or 503 response, or zero.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// printRetries prints how retries added to the load.
+func (r *report) printRetries() {
+	s := r.retries
+	r.printf("\nRetries:\n")
+	r.printf("  Retryable failures:\t%d of %d first attempts, %d still after the last attempt\n", s.FirstFailed, s.Requests, s.GaveUp)
+	r.printf("  Attempts:\t%d for %d requests, amplification %.2fx\n", s.Attempts, s.Requests, s.Amplification())
+	if s.Requests > 0 {
+		r.printf("  End to end:\t%4.4f secs average, %4.4f secs slowest\n",
+			s.Elapsed.Seconds()/float64(s.Requests), s.SlowestElapsed.Seconds())
+	}
+	counts := make([]int, 0, len(s.ByRetries))
+	for n := range s.ByRetries {
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+	for _, n := range counts {
+		r.printf("  Retried %d times:\t%d requests\n", n, s.ByRetries[n])
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// A Signer signs a request once it is built from the Work's Request and
+// an input row, right before it is sent. Every attempt of a request is
+// signed anew. Sign is called from many goroutines at once.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// sign reads the body of req, leaving it in place, and has the Work's
+// Signer sign req.
+func (b *Work) sign(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return b.Signer.Sign(req, body)
+}
+
+// SignData is what the templates of HMACSigner and JWTSigner are executed
+// with.
+type SignData struct {
+	Method string
+	Host   string
+	Path   string
+	Query  string
+
+	// Body is the request body and BodySHA256 its hex-encoded SHA-256.
+	Body       string
+	BodySHA256 string
+
+	// Now is the Unix time of signing and Exp that of expiry, for
+	// JWTSigner. Nonce is a random hex string.
+	Now   int64
+	Exp   int64
+	Nonce string
+
+	req *http.Request
+}
+
+// Header returns the value of a request header.
+func (d *SignData) Header(name string) string {
+	if d.req == nil {
+		return ""
+	}
+	return d.req.Header.Get(name)
+}
+
+func newSignData(req *http.Request, body []byte, now time.Time) *SignData {
+	sum := sha256.Sum256(body)
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	d := &SignData{
+		Body:       string(body),
+		BodySHA256: hex.EncodeToString(sum[:]),
+		Now:        now.Unix(),
+		Nonce:      hex.EncodeToString(nonce),
+		req:        req,
+	}
+	if req != nil {
+		d.Method = req.Method
+		d.Host = req.Host
+		d.Path = req.URL.EscapedPath()
+		d.Query = req.URL.RawQuery
+	}
+	return d
+}
+
+// parsedTemplate parses a template once and keeps the result or the error.
+type parsedTemplate struct {
+	once sync.Once
+	tmpl *template.Template
+	err  error
+}
+
+func (p *parsedTemplate) execute(text string, data *SignData) (string, error) {
+	p.once.Do(func() {
+		p.tmpl, p.err = template.New("sign").Option("missingkey=error").Parse(text)
+	})
+	if p.err != nil {
+		return "", p.err
+	}
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DefaultCanonical is the string HMACSigner signs by default.
+const DefaultCanonical = "{{.Method}}\n{{.Path}}\n{{.Query}}\n{{.Now}}\n{{.BodySHA256}}"
+
+// HMACSigner puts an HMAC-SHA256 of the request into a header.
+type HMACSigner struct {
+	Key []byte
+
+	// Canonical is a text/template of the signed string, executed with a
+	// *SignData. If empty, DefaultCanonical is used.
+	Canonical string
+
+	// Header receives the hex-encoded signature, or the base64-encoded one
+	// if Base64 is set. If empty, X-Signature is used.
+	Header string
+	Base64 bool
+
+	// TimestampHeader, if set, receives the Unix time that was signed, so
+	// that the server can rebuild the signed string.
+	TimestampHeader string
+
+	tmpl parsedTemplate
+}
+
+func (s *HMACSigner) Sign(req *http.Request, body []byte) error {
+	canonical := s.Canonical
+	if canonical == "" {
+		canonical = DefaultCanonical
+	}
+	data := newSignData(req, body, time.Now())
+	if s.TimestampHeader != "" {
+		req.Header.Set(s.TimestampHeader, strconv.FormatInt(data.Now, 10))
+	}
+	str, err := s.tmpl.execute(canonical, data)
+	if err != nil {
+		return fmt.Errorf("hmac signer: %v", err)
+	}
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(str))
+	sig := hex.EncodeToString(mac.Sum(nil))
+	if s.Base64 {
+		sig = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	header := s.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	req.Header.Set(header, sig)
+	return nil
+}
+
+// SigV4Signer signs requests with AWS Signature Version 4.
+type SigV4Signer struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+	Service      string
+
+	// ContentSHA256 sends and signs the X-Amz-Content-Sha256 header, which
+	// S3 requires.
+	ContentSHA256 bool
+
+	now func() time.Time // for tests
+}
+
+func (s *SigV4Signer) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	if s.ContentSHA256 {
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, sig))
+	return nil
+}
+
+// canonicalQuery returns q sorted and encoded the way SigV4 wants it.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes s except for the unreserved characters of RFC
+// 3986.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// DefaultClaims are the JWT claims JWTSigner issues by default.
+const DefaultClaims = `{"iat":{{.Now}},"exp":{{.Exp}}}`
+
+// JWTSigner sends a JSON Web Token as a bearer token. The token is reused
+// until a tenth of its lifetime is left, unless PerRequest is set.
+type JWTSigner struct {
+	// Alg is HS256, with Key the shared secret, or RS256, with Key an RSA
+	// private key in PEM.
+	Alg string
+	Key []byte
+
+	// Claims is a text/template of the JSON claims, executed with a
+	// *SignData. If empty, DefaultClaims is used.
+	Claims string
+
+	// TTL is the lifetime of a token. If zero, it is an hour.
+	TTL time.Duration
+
+	// PerRequest issues a token for every request, for claims that differ
+	// per request, such as a nonce or the body hash.
+	PerRequest bool
+
+	// Header receives the token, after "Bearer ". If empty, Authorization
+	// is used.
+	Header string
+
+	tmpl    parsedTemplate
+	keyOnce sync.Once
+	rsaKey  *rsa.PrivateKey
+	keyErr  error
+
+	mu      sync.Mutex
+	token   string
+	refresh time.Time // when to issue the next token
+}
+
+func (s *JWTSigner) Sign(req *http.Request, body []byte) error {
+	var token string
+	var err error
+	if s.PerRequest {
+		token, _, err = s.issue(req, body)
+	} else {
+		s.mu.Lock()
+		if s.token == "" || !time.Now().Before(s.refresh) {
+			s.token, s.refresh, err = s.issue(req, body)
+		}
+		token = s.token
+		s.mu.Unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("jwt signer: %v", err)
+	}
+	header := s.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	req.Header.Set(header, "Bearer "+token)
+	return nil
+}
+
+// issue returns a new token and when to replace it.
+func (s *JWTSigner) issue(req *http.Request, body []byte) (string, time.Time, error) {
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	now := time.Now()
+	data := newSignData(req, body, now)
+	data.Exp = now.Add(ttl).Unix()
+	text := s.Claims
+	if text == "" {
+		text = DefaultClaims
+	}
+	claims, err := s.tmpl.execute(text, data)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !json.Valid([]byte(claims)) {
+		return "", time.Time{}, fmt.Errorf("claims are not valid JSON: %s", claims)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": s.Alg, "typ": "JWT"})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString([]byte(claims))
+	var sig []byte
+	switch s.Alg {
+	case "HS256":
+		sig = hmacSHA256(s.Key, signed)
+	case "RS256":
+		key, err := s.privateKey()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		hash := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:]); err != nil {
+			return "", time.Time{}, err
+		}
+	default:
+		return "", time.Time{}, fmt.Errorf("unsupported algorithm %q, use HS256 or RS256", s.Alg)
+	}
+	return signed + "." + enc.EncodeToString(sig), now.Add(ttl - ttl/10), nil
+}
+
+// privateKey parses the PEM key of an RS256 signer once.
+func (s *JWTSigner) privateKey() (*rsa.PrivateKey, error) {
+	s.keyOnce.Do(func() {
+		block, _ := pem.Decode(s.Key)
+		if block == nil {
+			s.keyErr = errors.New("no PEM private key")
+			return
+		}
+		if s.rsaKey, s.keyErr = x509.ParsePKCS1PrivateKey(block.Bytes); s.keyErr == nil {
+			return
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			s.keyErr = err
+			return
+		}
+		var ok bool
+		if s.rsaKey, ok = key.(*rsa.PrivateKey); !ok {
+			s.keyErr = errors.New("not an RSA private key")
+		} else {
+			s.keyErr = nil
+		}
+	})
+	return s.rsaKey, s.keyErr
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sinkQueue is the number of results a sink may fall behind by before
+	// results are dropped.
+	sinkQueue = 10000
+
+	// sinkBatch is the largest batch of results written at once.
+	sinkBatch = 500
+
+	// sinkFlush is how long a partial batch waits for more results.
+	sinkFlush = time.Second
+)
+
+// A Sink stores results elsewhere, such as in a time series database.
+// Sinks are fed from the reporter in batches. Write is never called
+// concurrently for one sink, and a sink that falls behind loses results
+// rather than slowing down the test.
+type Sink interface {
+	Write(results []Result) error
+}
+
+// SinkStats counts what happened to the results fed to a sink.
+type SinkStats struct {
+	Name    string
+	Written int // results written
+	Dropped int // results lost because the sink fell behind
+	Failed  int // results lost in failed writes
+}
+
+// sinkWriter batches results for one sink on its own goroutine.
+type sinkWriter struct {
+	sink  Sink
+	queue chan Result
+	done  chan struct{}
+	stats SinkStats // stats.Dropped is owned by feed, the rest by run
+}
+
+func startSink(s Sink) *sinkWriter {
+	sw := &sinkWriter{
+		sink:  s,
+		queue: make(chan Result, sinkQueue),
+		done:  make(chan struct{}),
+		stats: SinkStats{Name: fmt.Sprint(s)},
+	}
+	go sw.run()
+	return sw
+}
+
+// feed queues res without blocking.
+func (sw *sinkWriter) feed(res Result) {
+	select {
+	case sw.queue <- res:
+	default:
+		sw.stats.Dropped++
+	}
+}
+
+func (sw *sinkWriter) run() {
+	defer close(sw.done)
+	ticker := time.NewTicker(sinkFlush)
+	defer ticker.Stop()
+	batch := make([]Result, 0, sinkBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := sw.sink.Write(batch); err != nil {
+			Error.Printf("sink %s: %v\n", sw.stats.Name, err)
+			sw.stats.Failed += len(batch)
+		} else {
+			sw.stats.Written += len(batch)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case res, ok := <-sw.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, res)
+			if len(batch) == sinkBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close writes the results still queued and returns the stats.
+func (sw *sinkWriter) close() SinkStats {
+	close(sw.queue)
+	<-sw.done
+	return sw.stats
+}
+
+// postBatch sends body to url and fails unless the response is a 2xx.
+func postBatch(c *http.Client, url string, header http.Header, body []byte) error {
+	if c == nil {
+		c = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
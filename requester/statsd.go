@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// statsdPacket is the largest UDP payload sent, small enough not to be
+// fragmented on common networks.
+const statsdPacket = 1432
+
+// StatsdSink sends results to a statsd server over UDP: the counters
+// <prefix>.requests.<code> and <prefix>.errors.<class>, and the timer
+// <prefix>.duration in milliseconds. If Tag is set on a result, it is
+// inserted after the prefix.
+type StatsdSink struct {
+	// Addr is the host:port of the statsd server.
+	Addr string
+
+	// Prefix starts every metric name. Default is "meg".
+	Prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *StatsdSink) String() string {
+	return "statsd " + s.Addr
+}
+
+func (s *StatsdSink) Write(results []Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.Addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var packet bytes.Buffer
+	send := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, res := range results {
+		name := s.Prefix
+		if name == "" {
+			name = "meg"
+		}
+		if res.Tag != "" {
+			name += "." + statsdName(res.Tag)
+		}
+		var lines []string
+		if res.Err != nil {
+			lines = append(lines, name+".errors."+errorClass(res.Err)+":1|c")
+		} else {
+			lines = append(lines,
+				name+".requests."+strconv.Itoa(res.StatusCode)+":1|c",
+				name+".duration:"+strconv.FormatFloat(res.Duration.Seconds()*1000, 'f', 3, 64)+"|ms")
+		}
+		for _, line := range lines {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacket {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	return send()
+}
+
+// statsdName replaces the characters that have a meaning in the statsd
+// protocol.
+func statsdName(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_", " ", "_").Replace(s)
+}
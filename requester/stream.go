@@ -0,0 +1,126 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStreamDelimiter separates Server-Sent Events.
+const DefaultStreamDelimiter = "\n\n"
+
+// maxEventSize is the largest event a streamed response may contain.
+const maxEventSize = 16 << 20
+
+// streamResult holds the per-event timings of one streamed response.
+type streamResult struct {
+	events     int
+	firstEvent time.Duration   // from the start of the request to the first event
+	gaps       []time.Duration // between consecutive events
+	size       int64
+	truncated  bool         // cut off by MaxStreamDuration
+	body       bytes.Buffer // the start of the body, if it may be captured
+}
+
+// readStream reads resp.Body event by event, timing each one relative to
+// the request start s. The body is closed early once MaxStreamDuration has
+// passed since s. The events are printed as they arrive, with the input
+// row, or as much of the body as is captured is kept.
+func (b *Work) readStream(resp *http.Response, s time.Time, input []byte) (*streamResult, error) {
+	st := &streamResult{}
+	capture := b.Capture.want(resp.StatusCode/100 == 2, nil)
+	print := !capture && b.printResponses()
+	var limit int
+	if capture {
+		limit = b.Capture.maxBody() + 1 // one more byte tells that it was cut off
+	}
+	var cut int32
+	if b.MaxStreamDuration > 0 {
+		timer := time.AfterFunc(b.MaxStreamDuration-time.Now().Sub(s), func() {
+			atomic.StoreInt32(&cut, 1)
+			resp.Body.Close()
+		})
+		defer timer.Stop()
+	}
+
+	delim := []byte(b.StreamDelimiter)
+	if len(delim) == 0 {
+		delim = []byte(DefaultStreamDelimiter)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	scanner.Split(splitOn(delim))
+
+	last := s
+	for scanner.Scan() {
+		now := time.Now()
+		event := scanner.Bytes()
+		st.size += int64(len(event) + len(delim))
+		if len(bytes.TrimSpace(event)) == 0 {
+			continue
+		}
+		if st.events == 0 {
+			st.firstEvent = now.Sub(s)
+		} else {
+			st.gaps = append(st.gaps, now.Sub(last))
+		}
+		st.events++
+		last = now
+		if capture {
+			writeUpTo(&st.body, limit, event, delim)
+		} else if print {
+			Info.Printf("%s\t%d\t%s\n", bytes.TrimSpace(input), resp.StatusCode, bytes.TrimSpace(event))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if atomic.LoadInt32(&cut) == 0 {
+			return nil, err
+		}
+		st.truncated = true
+	}
+	return st, nil
+}
+
+// writeUpTo appends parts to buf until it holds limit bytes.
+func writeUpTo(buf *bytes.Buffer, limit int, parts ...[]byte) {
+	for _, p := range parts {
+		n := min(len(p), limit-buf.Len())
+		if n <= 0 {
+			return
+		}
+		buf.Write(p[:n])
+	}
+}
+
+// splitOn returns a bufio.SplitFunc splitting on delim. A trailing event
+// without delimiter is returned at EOF.
+func splitOn(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
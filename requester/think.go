@@ -0,0 +1,193 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ThinkTime is the pause a worker takes between iterations, the way a user
+// reads a page before the next click.
+type ThinkTime struct {
+	// Dist is the distribution of the pauses: "constant" pauses for Min,
+	// "uniform" draws between Min and Max, "normal" draws around Mean with
+	// StdDev and "exponential" draws with Mean. Normal and exponential
+	// pauses are kept between Min and Max if Max is set.
+	Dist string
+
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// validate checks the distribution and bounds of t.
+func (t *ThinkTime) validate() error {
+	switch t.Dist {
+	case "constant", "uniform", "normal", "exponential":
+	default:
+		return fmt.Errorf("unknown think time distribution %q, use constant, uniform, normal or exponential", t.Dist)
+	}
+	if t.Min < 0 || t.Max < 0 || t.Mean < 0 || t.StdDev < 0 {
+		return errors.New("think times cannot be negative")
+	}
+	if (t.Max > 0 || t.Dist == "uniform") && t.Max < t.Min {
+		return errors.New("maximum think time cannot be less than the minimum")
+	}
+	return nil
+}
+
+// next draws a pause.
+func (t *ThinkTime) next() time.Duration {
+	var d time.Duration
+	switch t.Dist {
+	case "constant":
+		return t.Min
+	case "uniform":
+		return t.Min + time.Duration(rand.Int63n(int64(t.Max-t.Min)+1))
+	case "normal":
+		d = t.Mean + time.Duration(rand.NormFloat64()*float64(t.StdDev))
+	case "exponential":
+		d = time.Duration(rand.ExpFloat64() * float64(t.Mean))
+	}
+	d = max(d, t.Min)
+	if t.Max > 0 {
+		d = min(d, t.Max)
+	}
+	return d
+}
+
+// ThinkStats tells how the time of the workers was split between waiting
+// for responses and thinking or pacing between iterations.
+type ThinkStats struct {
+	// Iterations is the number of iterations of all workers, and Service
+	// the time they spent waiting for responses.
+	Iterations int
+	Service    time.Duration
+
+	// Pauses is the number of pauses between iterations, and Think the
+	// time they took.
+	Pauses int
+	Think  time.Duration
+
+	// Pacing is the Work's Pacing and Overruns the number of iterations
+	// that took longer.
+	Pacing   time.Duration
+	Overruns int
+}
+
+func (s *ThinkStats) merge(o *ThinkStats) {
+	s.Iterations += o.Iterations
+	s.Service += o.Service
+	s.Pauses += o.Pauses
+	s.Think += o.Think
+	s.Pacing = max(s.Pacing, o.Pacing)
+	s.Overruns += o.Overruns
+}
+
+// thinkCounter collects the ThinkStats of all workers.
+type thinkCounter struct {
+	mu sync.Mutex
+	s  ThinkStats
+}
+
+func (c *thinkCounter) add(f func(s *ThinkStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.s)
+}
+
+func (c *thinkCounter) stats() *ThinkStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.s
+	return &s
+}
+
+// pausing reports whether workers pause between iterations.
+func (b *Work) pausing() bool {
+	return b.Think != nil || b.Pacing > 0
+}
+
+// validatePause checks Think and Pacing.
+func (b *Work) validatePause() error {
+	if b.Think != nil && b.Pacing > 0 {
+		return errors.New("think time and pacing cannot be used together")
+	}
+	if b.pausing() && b.Async {
+		return errors.New("think time and pacing need synchronous workers")
+	}
+	if b.Pacing < 0 {
+		return errors.New("pacing cannot be negative")
+	}
+	if b.Think != nil {
+		return b.Think.validate()
+	}
+	return nil
+}
+
+// pause waits between two iterations of a worker, the last of which took
+// service. It returns false if the test is cancelled meanwhile.
+func (b *Work) pause(service time.Duration) bool {
+	var d time.Duration
+	overrun := false
+	if b.Think != nil {
+		d = b.Think.next()
+	} else {
+		d = b.Pacing - service
+		overrun = d < 0
+		d = max(d, 0)
+	}
+	b.thinks.add(func(s *ThinkStats) {
+		s.Pauses++
+		s.Think += d
+		if overrun {
+			s.Overruns++
+		}
+	})
+	if d == 0 {
+		return !b.stopped()
+	}
+	select {
+	case <-time.After(d):
+		return !b.stopped()
+	case <-b.done():
+		return false
+	}
+}
+
+// printThink prints how the time of the workers was split between service
+// and think time.
+func (r *report) printThink() {
+	s := r.think
+	r.printf("\nThink time:\n")
+	r.printf("  Iterations:\t%d\n", s.Iterations)
+	if s.Iterations > 0 {
+		r.printf("  Service time:\t%4.4f secs per iteration\n", s.Service.Seconds()/float64(s.Iterations))
+	}
+	if s.Pauses > 0 {
+		r.printf("  Think time:\t%4.4f secs per pause\n", s.Think.Seconds()/float64(s.Pauses))
+	}
+	if s.Pacing > 0 {
+		r.printf("  Pacing:\t%4.4f secs, %d iterations overran\n", s.Pacing.Seconds(), s.Overruns)
+	}
+	if total := s.Service + s.Think; total > 0 {
+		r.printf("  Busy:\t%.1f%%\n", s.Service.Seconds()/total.Seconds()*100)
+	}
+}
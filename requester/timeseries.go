@@ -0,0 +1,184 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// TimeSeriesRenderer writes the requests of the test aggregated per
+// interval, as CSV or as JSON lines. Each interval holds the responses
+// completed and the requests failed in it, the responses by status class
+// and their latency percentiles.
+type TimeSeriesRenderer struct {
+	W io.Writer
+
+	// Interval is the length of each bucket. Default is one second.
+	Interval time.Duration
+
+	// JSON selects JSON lines instead of CSV.
+	JSON bool
+}
+
+// timeSeriesLine is the JSON form of one time bucket.
+type timeSeriesLine struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Offset    float64        `json:"offset"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	Status    map[string]int `json:"status"`
+	RPS       float64        `json:"rps"`
+	P50       float64        `json:"p50"`
+	P90       float64        `json:"p90"`
+	P95       float64        `json:"p95"`
+	P99       float64        `json:"p99"`
+}
+
+func (t *TimeSeriesRenderer) Render(rep *Report) error {
+	r := rep.r
+	interval := t.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	series := r.timeSeries(interval)
+	if t.JSON {
+		enc := json.NewEncoder(t.W)
+		for _, b := range series {
+			line := timeSeriesLine{
+				Timestamp: r.startTime.Add(seconds(b.start)),
+				Offset:    b.start,
+				Requests:  b.requests,
+				Errors:    b.errors,
+				Status:    make(map[string]int),
+				RPS:       b.rps,
+				P50:       b.p50,
+				P90:       b.p90,
+				P95:       b.p95,
+				P99:       b.p99,
+			}
+			for class, n := range b.classes {
+				if n > 0 {
+					line.Status[fmt.Sprintf("%dxx", class)] = n
+				}
+			}
+			if err := enc.Encode(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(t.W, "timestamp,offset,requests,errors,1xx,2xx,3xx,4xx,5xx,rps,p50,p90,p95,p99\n"); err != nil {
+		return err
+	}
+	for _, b := range series {
+		_, err := fmt.Fprintf(t.W, "%s,%g,%d,%d,%d,%d,%d,%d,%d,%4.4f,%4.4f,%4.4f,%4.4f,%4.4f\n",
+			r.startTime.Add(seconds(b.start)).Format(time.RFC3339Nano), b.start, b.requests, b.errors,
+			b.classes[1], b.classes[2], b.classes[3], b.classes[4], b.classes[5],
+			b.rps, b.p50, b.p90, b.p95, b.p99)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeBucket aggregates the requests completed within one interval of the
+// test.
+type timeBucket struct {
+	start    float64 // seconds since the start of the test
+	requests int
+	errors   int
+	classes  [6]int // responses by status code / 100
+	rps      float64
+	p50      float64
+	p90      float64
+	p95      float64
+	p99      float64
+}
+
+// timeSeries splits the test into intervals and aggregates the requests
+// completed in each. Responses count when they are complete, failed
+// requests when they are sent.
+func (r *report) timeSeries(interval time.Duration) []timeBucket {
+	step := interval.Seconds()
+	end := r.timeUsed.Seconds()
+	for i, s := range r.starts {
+		end = math.Max(end, s+r.lats[i])
+	}
+	n := int(math.Ceil(end / step))
+	if n == 0 {
+		return nil
+	}
+	lats := make([][]float64, n)
+	buckets := make([]timeBucket, n)
+	index := func(t float64) int {
+		return min(max(int(t/step), 0), n-1)
+	}
+	for i, s := range r.starts {
+		j := index(s + r.lats[i])
+		lats[j] = append(lats[j], r.lats[i])
+		if i < len(r.codes) {
+			if class := r.codes[i] / 100; class > 0 && class < len(buckets[j].classes) {
+				buckets[j].classes[class]++
+			}
+		}
+	}
+	for _, s := range r.errStarts {
+		buckets[index(s)].errors++
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		b.start = float64(i) * step
+		b.requests = len(lats[i])
+		b.rps = float64(b.requests) / step
+		if b.requests > 0 {
+			sort.Float64s(lats[i])
+			b.p50 = nearestRank(lats[i], 50)
+			b.p90 = nearestRank(lats[i], 90)
+			b.p95 = nearestRank(lats[i], 95)
+			b.p99 = nearestRank(lats[i], 99)
+		}
+	}
+	return buckets
+}
+
+// nearestRank returns the p-th percentile of the sorted, non-empty slice
+// vals. Unlike percentiles it is meaningful for a handful of values.
+func nearestRank(vals []float64, p int) float64 {
+	i := int(math.Ceil(float64(p)/100*float64(len(vals)))) - 1
+	return vals[max(i, 0)]
+}
+
+// chartInterval returns the shortest round interval splitting the test into
+// at most 120 buckets.
+func (r *report) chartInterval() time.Duration {
+	intervals := []time.Duration{
+		100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+		time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+		time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	}
+	for _, interval := range intervals {
+		if r.timeUsed/interval <= 120 {
+			return interval
+		}
+	}
+	return time.Hour
+}
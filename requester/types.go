@@ -2,6 +2,8 @@ package requester
 
 type RequestParam struct {
 	Content []byte
+
+	group *RequestGroup // set if the row belongs to one of the Work's Groups
 }
 
 type RequestParamSlice struct {
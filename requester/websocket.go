@@ -0,0 +1,221 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsStats holds the connection level numbers of a WebSocket run.
+type wsStats struct {
+	mu          sync.Mutex
+	connects    int
+	disconnects int
+	sent        int
+	received    int
+	connLats    []float64
+}
+
+func (s *wsStats) add(f func(s *wsStats)) {
+	s.mu.Lock()
+	f(s)
+	s.mu.Unlock()
+}
+
+func (b *Work) isWebSocket() bool {
+	return b.Request.URL.Scheme == "ws" || b.Request.URL.Scheme == "wss"
+}
+
+// wsConfig builds the handshake configuration from the request template.
+func (b *Work) wsConfig() (*websocket.Config, error) {
+	origin := "http://" + b.Request.URL.Host
+	if b.Request.URL.Scheme == "wss" {
+		origin = "https://" + b.Request.URL.Host
+	}
+	config, err := websocket.NewConfig(b.Request.URL.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	config.Header = make(http.Header, len(b.Request.Header))
+	for k, s := range b.Request.Header {
+		config.Header[k] = append([]string(nil), s...)
+	}
+	return config, nil
+}
+
+// runWSWorker sends the messages the worker takes on a WebSocket
+// connection, one at a time, measuring the time until the matching reply
+// arrives. A failed dial or exchange is reported as a failed request; a
+// broken connection is counted as a disconnect and dialed again for the
+// next message.
+func (b *Work) runWSWorker() {
+	config, cerr := b.wsConfig()
+
+	var conn *websocket.Conn
+	var stop func() bool // stops closing conn once in-flight requests are aborted
+	closeConn := func() {
+		stop()
+		conn.Close()
+		conn = nil
+	}
+	defer func() {
+		if conn != nil {
+			closeConn()
+		}
+	}()
+	b.runLoop(func(i int) {
+		p := b.getRequestParam(i)
+		if cerr != nil {
+			b.wsFailed(&p, time.Now(), cerr)
+			return
+		}
+		if conn == nil {
+			s := time.Now()
+			c, err := b.wsDial(config)
+			if err != nil {
+				b.wsFailed(&p, s, err)
+				return
+			}
+			conn = c
+			d := time.Now().Sub(s)
+			// Unblock a pending receive once in-flight requests are aborted.
+			stop = context.AfterFunc(b.context(), func() { c.Close() })
+			b.report.ws.add(func(s *wsStats) {
+				s.connects++
+				s.connLats = append(s.connLats, d.Seconds())
+			})
+		}
+
+		if s, err := b.wsExchange(conn, &p); err != nil {
+			b.wsFailed(&p, s, err)
+			b.report.ws.add(func(s *wsStats) { s.disconnects++ })
+			closeConn()
+		}
+	})
+}
+
+// wsFailed reports a message that got no reply because of err, started at
+// s.
+func (b *Work) wsFailed(p *RequestParam, s time.Time, err error) {
+	t := time.Now()
+	Error.Println(err)
+	if b.Capture.want(false, err) {
+		b.Capture.add(&CapturedResponse{
+			Time:     s,
+			Input:    string(p.Content),
+			URL:      b.Request.URL.String(),
+			Error:    err.Error(),
+			Duration: t.Sub(s).Seconds(),
+		})
+	}
+	b.sendResult(p, &Result{Start: s, Duration: t.Sub(s), Err: err})
+}
+
+// wsDial opens a connection, bounding the handshake by the request timeout.
+func (b *Work) wsDial(config *websocket.Config) (*websocket.Conn, error) {
+	ctx := b.context()
+	if b.SingleRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.SingleRequestTimeout)
+		defer cancel()
+	}
+	return config.DialContext(ctx)
+}
+
+// wsExchange sends one message and waits for its reply. If WSIDField is
+// set, the reply is the first message carrying the same value in that
+// JSON field; otherwise it is simply the next message received. It returns
+// when the message was sent and, if it got no reply, why.
+func (b *Work) wsExchange(conn *websocket.Conn, p *RequestParam) (time.Time, error) {
+	defer b.Metrics.request(b.TestName)()
+	var id []byte
+	if b.WSIDField != "" {
+		id = jsonField(p.Content, b.WSIDField)
+	}
+	if b.SingleRequestTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(b.SingleRequestTimeout))
+	}
+
+	s := time.Now()
+	if err := websocket.Message.Send(conn, string(p.Content)); err != nil {
+		return s, err
+	}
+	b.report.ws.add(func(s *wsStats) { s.sent++ })
+	wrote := time.Now()
+
+	var msg []byte
+	for {
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return s, err
+		}
+		b.report.ws.add(func(s *wsStats) { s.received++ })
+		if id == nil || bytes.Equal(jsonField(msg, b.WSIDField), id) {
+			break
+		}
+	}
+	t := time.Now()
+
+	if b.Capture.want(true, nil) {
+		b.Capture.add(&CapturedResponse{
+			Time:     s,
+			Input:    string(p.Content),
+			URL:      b.Request.URL.String(),
+			Status:   http.StatusSwitchingProtocols,
+			Duration: t.Sub(s).Seconds(),
+			Body:     string(msg),
+		})
+	} else if b.printResponses() {
+		Info.Printf("%s\t%s\n", bytes.TrimSpace(p.Content), bytes.TrimSpace(msg))
+	}
+
+	b.sendResult(p, &Result{
+		Start:         s,
+		StatusCode:    http.StatusSwitchingProtocols,
+		Duration:      t.Sub(s),
+		ReqDuration:   wrote.Sub(s),
+		DelayDuration: t.Sub(wrote),
+		ContentLength: int64(len(msg)),
+	})
+	return s, nil
+}
+
+// jsonField returns the compacted JSON value of key in the object msg, or
+// nil if msg is not an object or has no such key.
+func jsonField(msg []byte, key string) []byte {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &obj); err != nil {
+		return nil
+	}
+	v, ok := obj[key]
+	if !ok {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, v); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}